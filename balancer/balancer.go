@@ -0,0 +1,332 @@
+// Package balancer spreads HTTP requests over a pool of servers. A Balancer
+// is an http.Handler, so it can run on its own, as cmd/lb does, or inside of
+// another service.
+package balancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNoBackend is reported to the error hook when no server can take the
+// request.
+var ErrNoBackend = errors.New("no backend available")
+
+// Hooks customize the handling of the requests. All of them are optional.
+type Hooks struct {
+	// Request is called before a server is picked. It returns the request
+	// to balance, or nil once it has answered the request itself.
+	Request func(rw http.ResponseWriter, r *http.Request) *http.Request
+
+	// Forward is called with the request about to be sent to the picked
+	// server. It returns the request to send instead, and a function called
+	// with the status of the response once it is written.
+	Forward func(rw http.ResponseWriter, out *http.Request, server string) (*http.Request, func(status int))
+
+	// Respond writes the response of the server to the client. By default
+	// its headers, status and body are copied.
+	Respond func(rw http.ResponseWriter, r *http.Request, resp *http.Response) error
+
+	// Error answers the request when no server is available, with
+	// ErrNoBackend, or the server failed to respond. By default it answers
+	// with 503 and 502 respectively.
+	Error func(rw http.ResponseWriter, r *http.Request, server string, err error)
+
+	// Health is called with every change of a server health once the
+	// balancer is started. By default healthy servers join the pool and
+	// failing ones leave it, while with the hook it is up to the hook.
+	Health func(change StateChange)
+}
+
+// Balancer forwards every request to a server of its pool picked by its
+// strategy. With a health checker, it moves the servers in and out of the
+// pool between Start and Stop.
+type Balancer struct {
+	pool *Pool
+	strategy Strategy
+	transport http.RoundTripper
+	scheme string
+	hooks Hooks
+
+	monitor *HealthMonitor
+	startOnce sync.Once
+}
+
+type Option func(*Balancer)
+
+// WithPool balances between the servers of the pool, empty by default.
+func WithPool(pool *Pool) Option {
+	return func(b *Balancer) { b.pool = pool }
+}
+
+// WithStrategy picks the servers with the strategy, HashStrategy by default.
+func WithStrategy(strategy Strategy) Option {
+	return func(b *Balancer) { b.strategy = strategy }
+}
+
+// WithHealthChecker checks every server of the pool on the interval once the
+// balancer is started.
+func WithHealthChecker(check HealthChecker, interval time.Duration) Option {
+	return func(b *Balancer) { b.monitor = NewHealthMonitor(check, interval) }
+}
+
+// WithTransport sends the requests with the transport, http.DefaultTransport
+// by default.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(b *Balancer) { b.transport = transport }
+}
+
+// WithScheme talks to the servers over the scheme, http by default.
+func WithScheme(scheme string) Option {
+	return func(b *Balancer) { b.scheme = scheme }
+}
+
+func WithHooks(hooks Hooks) Option {
+	return func(b *Balancer) { b.hooks = hooks }
+}
+
+func New(options ...Option) *Balancer {
+	b := &Balancer{
+		pool: NewPool(),
+		strategy: HashStrategy{},
+		transport: http.DefaultTransport,
+		scheme: "http",
+	}
+
+	for _, option := range options {
+		option(b)
+	}
+
+	return b
+}
+
+func (b *Balancer) Pool() *Pool {
+	return b.pool
+}
+
+// Monitor returns the health monitor of the balancer, nil without a health
+// checker. Servers outside of the pool are checked once added to it.
+func (b *Balancer) Monitor() *HealthMonitor {
+	return b.monitor
+}
+
+// Start checks the health of the servers in the pool and the ones added to
+// the monitor until ctx is done or Stop is called. Servers failing the check
+// leave the pool and come back once they pass it again, unless the Health
+// hook handles the changes. Without a health checker it does nothing.
+func (b *Balancer) Start(ctx context.Context) {
+	if b.monitor == nil {
+		return
+	}
+
+	b.startOnce.Do(func() {
+		for _, server := range b.pool.Servers() {
+			b.monitor.Add(server)
+		}
+
+		b.monitor.Start(ctx)
+
+		go func() {
+			for change := range b.monitor.Changes() {
+				b.healthChanged(change)
+			}
+		}()
+	})
+}
+
+func (b *Balancer) healthChanged(change StateChange) {
+	if b.hooks.Health != nil {
+		b.hooks.Health(change)
+		return
+	}
+
+	if change.Healthy {
+		b.pool.Add(change.Target)
+	} else {
+		b.pool.Remove(change.Target)
+	}
+}
+
+func (b *Balancer) Stop() {
+	if b.monitor != nil {
+		b.monitor.Stop()
+	}
+}
+
+func (b *Balancer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if b.hooks.Request != nil {
+		if r = b.hooks.Request(rw, r); r == nil {
+			return
+		}
+	}
+
+	server := b.strategy.Pick(r, b.pool.Servers())
+
+	if server == "" {
+		b.fail(rw, r, "", ErrNoBackend)
+		return
+	}
+
+	_ = b.Forward(server, rw, r)
+}
+
+// Forward sends the request to the server, skipping the strategy. It returns
+// the error of a server that failed to respond.
+func (b *Balancer) Forward(server string, rw http.ResponseWriter, r *http.Request) error {
+	recorder := &statusRecorder{ResponseWriter: rw}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Host = server
+	out.URL.Scheme = b.scheme
+	out.Host = server
+
+	var done func(int)
+	if b.hooks.Forward != nil {
+		out, done = b.hooks.Forward(recorder, out, server)
+	}
+
+	err := b.roundTrip(recorder, r, out, server)
+
+	if done != nil {
+		done(recorder.status)
+	}
+
+	return err
+}
+
+func (b *Balancer) roundTrip(rw http.ResponseWriter, r, out *http.Request, server string) error {
+	observer, observes := b.strategy.(Observer)
+
+	if observes {
+		observer.Started(server)
+	}
+
+	start := time.Now()
+	resp, err := b.transport.RoundTrip(out)
+
+	if observes {
+		observer.Finished(server, time.Since(start), err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	}
+
+	if err != nil {
+		b.fail(rw, r, server, err)
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	respond := b.hooks.Respond
+	if respond == nil {
+		respond = copyResponse
+	}
+
+	if err := respond(rw, r, resp); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+
+	return nil
+}
+
+func (b *Balancer) fail(rw http.ResponseWriter, r *http.Request, server string, err error) {
+	if b.hooks.Error != nil {
+		b.hooks.Error(rw, r, server, err)
+		return
+	}
+
+	if errors.Is(err, ErrNoBackend) {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Failed to get response from %s: %s", server, err)
+	http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+}
+
+// copyResponse writes the response as is.
+func copyResponse(rw http.ResponseWriter, r *http.Request, resp *http.Response) error {
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+
+	rw.WriteHeader(resp.StatusCode)
+
+	return CopyBody(rw, resp, func() error {
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	})
+}
+
+const copyBufferSize = 32 * 1024
+
+// CopyBody writes the body of the response to dst, calling flush after every
+// read of a body of unknown length so streaming keeps working.
+func CopyBody(dst io.Writer, resp *http.Response, flush func() error) error {
+	streaming := resp.ContentLength == -1
+	buffer := make([]byte, copyBufferSize)
+
+	for {
+		n, err := resp.Body.Read(buffer)
+
+		if n > 0 {
+			if _, writeErr := dst.Write(buffer[:n]); writeErr != nil {
+				return writeErr
+			}
+
+			if streaming {
+				if flushErr := flush(); flushErr != nil {
+					return flushErr
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// statusRecorder remembers the status of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,198 @@
+package balancer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func namedBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("backend", name)
+		_, _ = io.WriteString(rw, name + " " + r.URL.Path)
+	}))
+}
+
+func address(server *httptest.Server) string {
+	return server.Listener.Addr().String()
+}
+
+func TestBalancerForwards(t *testing.T) {
+	backend := namedBackend("one")
+	defer backend.Close()
+
+	b := New(WithPool(NewPool(address(backend))))
+
+	rw := httptest.NewRecorder()
+	b.ServeHTTP(rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "one", rw.Header().Get("backend"))
+	assert.Equal(t, "one /api/v1/some-data", rw.Body.String())
+}
+
+func TestBalancerNoBackend(t *testing.T) {
+	rw := httptest.NewRecorder()
+	New().ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	// a closed listener leaves a port nobody accepts connections on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	dead := listener.Addr().String()
+	listener.Close()
+
+	rw = httptest.NewRecorder()
+	err = New().Forward(dead, rw, httptest.NewRequest("GET", "/", nil))
+
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestBalancerStrategy(t *testing.T) {
+	one := namedBackend("one")
+	defer one.Close()
+	two := namedBackend("two")
+	defer two.Close()
+
+	b := New(
+		WithPool(NewPool(address(one), address(two))),
+		WithStrategy(StrategyFunc(func(r *http.Request, servers []string) string {
+			return servers[len(servers) - 1]
+		})),
+	)
+
+	for i := 0; i < 10; i++ {
+		rw := httptest.NewRecorder()
+		b.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+		assert.Equal(t, "two", rw.Header().Get("backend"))
+	}
+}
+
+func TestBalancerHooks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(rw, r.Header.Get("forwarded-to"))
+	}))
+	defer backend.Close()
+
+	var statuses []int
+	var failed []error
+
+	b := New(
+		WithPool(NewPool(address(backend))),
+		WithHooks(Hooks{
+			Request: func(rw http.ResponseWriter, r *http.Request) *http.Request {
+				if r.URL.Path == "/forbidden" {
+					rw.WriteHeader(http.StatusForbidden)
+					return nil
+				}
+				return r
+			},
+			Forward: func(rw http.ResponseWriter, out *http.Request, server string) (*http.Request, func(int)) {
+				out.Header.Set("forwarded-to", server)
+				return out, func(status int) { statuses = append(statuses, status) }
+			},
+			Respond: func(rw http.ResponseWriter, r *http.Request, resp *http.Response) error {
+				rw.Header().Set("respond", "hook")
+				rw.WriteHeader(http.StatusAccepted)
+				_, err := io.Copy(rw, resp.Body)
+				return err
+			},
+			Error: func(rw http.ResponseWriter, r *http.Request, server string, err error) {
+				failed = append(failed, err)
+				rw.WriteHeader(http.StatusTeapot)
+			},
+		}),
+	)
+
+	rw := httptest.NewRecorder()
+	b.ServeHTTP(rw, httptest.NewRequest("GET", "/forbidden", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Empty(t, statuses, "rejected requests are not forwarded")
+
+	rw = httptest.NewRecorder()
+	b.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "hook", rw.Header().Get("respond"))
+	assert.Equal(t, address(backend), rw.Body.String())
+	assert.Equal(t, []int{http.StatusAccepted}, statuses)
+
+	b.Pool().Set(nil)
+
+	rw = httptest.NewRecorder()
+	b.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusTeapot, rw.Code)
+	assert.Equal(t, []error{ErrNoBackend}, failed)
+}
+
+func TestBalancerHealthChecks(t *testing.T) {
+	one := namedBackend("one")
+	defer one.Close()
+	two := namedBackend("two")
+	defer two.Close()
+
+	m := sync.Mutex{}
+	alive := map[string]bool{address(one): true, address(two): true}
+
+	check := func(server string) bool {
+		m.Lock()
+		defer m.Unlock()
+		return alive[server]
+	}
+
+	b := New(
+		WithPool(NewPool(address(one), address(two))),
+		WithHealthChecker(check, time.Millisecond),
+	)
+	b.Start(context.Background())
+	defer b.Stop()
+
+	m.Lock()
+	alive[address(one)] = false
+	m.Unlock()
+
+	assert.Eventually(t, func() bool {
+		servers := b.Pool().Servers()
+		return len(servers) == 1 && servers[0] == address(two)
+	}, time.Second, time.Millisecond)
+
+	m.Lock()
+	alive[address(one)] = true
+	m.Unlock()
+
+	assert.Eventually(t, func() bool { return len(b.Pool().Servers()) == 2 }, time.Second, time.Millisecond)
+}
+
+func TestBalancerHealthHook(t *testing.T) {
+	one := namedBackend("one")
+	defer one.Close()
+
+	changes := make(chan StateChange, 4)
+
+	b := New(
+		WithPool(NewPool(address(one))),
+		WithHealthChecker(func(server string) bool { return server == address(one) }, time.Millisecond),
+		WithHooks(Hooks{Health: func(change StateChange) { changes <- change }}),
+	)
+	b.Monitor().Add("outside:8080")
+	b.Start(context.Background())
+	defer b.Stop()
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		change := <-changes
+		seen[change.Target] = change.Healthy
+	}
+
+	assert.Equal(t, map[string]bool{address(one): true, "outside:8080": false}, seen, "servers outside of the pool are checked too")
+	assert.Equal(t, []string{address(one)}, b.Pool().Servers(), "the hook owns the pool membership")
+}
@@ -0,0 +1,173 @@
+package balancer
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Observer is implemented by strategies learning from the requests they
+// route. The balancer reports every request sent to a server, the time the
+// server took to respond and whether it failed to.
+type Observer interface {
+	Started(server string)
+	Finished(server string, latency time.Duration, failed bool)
+}
+
+// ewmaFailurePenalty is the least latency a failed request counts as, so
+// servers failing fast do not attract the traffic.
+const ewmaFailurePenalty = time.Second
+
+type ewmaStats struct {
+	// cost is the moving average of the latency in nanoseconds
+	cost float64
+	stamp time.Time
+	inFlight int64
+}
+
+// PeakEWMA picks the server with the lowest expected latency. It keeps a
+// moving average of the latencies of every server that jumps to a new peak
+// right away and decays slowly, and multiplies it by the active requests of
+// the server plus one. The average of a server without traffic decays too,
+// so a server that was slow once is eventually tried again.
+type PeakEWMA struct {
+	// Decay is the time over which a latency loses most of its weight.
+	Decay time.Duration
+	// Affinity keeps clients on the server they hash to while its cost is
+	// within Affinity times the lowest one. Without it the hash only breaks
+	// the ties between the cheapest servers.
+	Affinity float64
+	// Key is the client address by default.
+	Key func(r *http.Request) string
+
+	m sync.Mutex
+	stats map[string]*ewmaStats
+}
+
+func NewPeakEWMA(decay time.Duration, affinity float64) *PeakEWMA {
+	return &PeakEWMA{Decay: decay, Affinity: affinity, stats: map[string]*ewmaStats{}}
+}
+
+// statsOf has to be called with the strategy locked.
+func (p *PeakEWMA) statsOf(server string) *ewmaStats {
+	if p.stats == nil {
+		p.stats = map[string]*ewmaStats{}
+	}
+
+	stats, known := p.stats[server]
+	if !known {
+		stats = &ewmaStats{}
+		p.stats[server] = stats
+	}
+
+	return stats
+}
+
+// decayed returns the weight left of a value observed elapsed ago.
+func (p *PeakEWMA) decayed(elapsed time.Duration) float64 {
+	if p.Decay <= 0 || elapsed <= 0 {
+		return 1
+	}
+
+	return math.Exp(-float64(elapsed) / float64(p.Decay))
+}
+
+func (p *PeakEWMA) Started(server string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.statsOf(server).inFlight += 1
+}
+
+func (p *PeakEWMA) Finished(server string, latency time.Duration, failed bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	stats := p.statsOf(server)
+	now := time.Now()
+
+	if stats.inFlight > 0 {
+		stats.inFlight -= 1
+	}
+
+	rtt := float64(latency)
+	if failed {
+		rtt = max(rtt, float64(ewmaFailurePenalty))
+	}
+
+	if rtt > stats.cost {
+		stats.cost = rtt
+	} else {
+		weight := p.decayed(now.Sub(stats.stamp))
+		stats.cost = stats.cost * weight + rtt * (1 - weight)
+	}
+
+	stats.stamp = now
+}
+
+// cost has to be called with the strategy locked.
+func (p *PeakEWMA) cost(server string, now time.Time) float64 {
+	stats, known := p.stats[server]
+	if !known {
+		return 1
+	}
+
+	// servers not measured yet still compare by their active requests
+	latency := max(stats.cost * p.decayed(now.Sub(stats.stamp)), 1)
+
+	return latency * float64(stats.inFlight + 1)
+}
+
+// Cost returns the expected latency of a request sent to the server now.
+func (p *PeakEWMA) Cost(server string) time.Duration {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return time.Duration(p.cost(server, time.Now()))
+}
+
+// Choose picks the cheapest of the servers for the client key.
+func (p *PeakEWMA) Choose(key string, servers []string) string {
+	if len(servers) == 0 {
+		return ""
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	now := time.Now()
+	costs := make([]float64, len(servers))
+	best := math.Inf(1)
+
+	for i, server := range servers {
+		costs[i] = p.cost(server, now)
+		best = min(best, costs[i])
+	}
+
+	keyHash := Hash(key)
+
+	if p.Affinity > 0 {
+		if i := keyHash % uint64(len(servers)); costs[i] <= best * p.Affinity {
+			return servers[i]
+		}
+	}
+
+	var cheapest []string
+	for i, server := range servers {
+		if costs[i] == best {
+			cheapest = append(cheapest, server)
+		}
+	}
+
+	return cheapest[keyHash % uint64(len(cheapest))]
+}
+
+func (p *PeakEWMA) Pick(r *http.Request, servers []string) string {
+	key := r.RemoteAddr
+	if p.Key != nil {
+		key = p.Key(r)
+	}
+
+	return p.Choose(key, servers)
+}
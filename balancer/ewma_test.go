@@ -0,0 +1,120 @@
+package balancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeakEWMACost(t *testing.T) {
+	p := NewPeakEWMA(20 * time.Millisecond, 0)
+
+	p.Finished("a", 100 * time.Millisecond, false)
+	assert.InDelta(t, 100 * time.Millisecond, p.Cost("a"), float64(10 * time.Millisecond))
+
+	// a fast response right after a slow one barely moves the average
+	p.Finished("a", time.Millisecond, false)
+	assert.Greater(t, p.Cost("a"), 80 * time.Millisecond)
+
+	// while a new peak is taken right away
+	p.Finished("a", 200 * time.Millisecond, false)
+	assert.Greater(t, p.Cost("a"), 180 * time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Less(t, p.Cost("a"), 10 * time.Millisecond, "the average decays without traffic")
+
+	p.Finished("b", 10 * time.Millisecond, false)
+	idle := p.Cost("b")
+	p.Started("b")
+	p.Started("b")
+	assert.InDelta(t, 3 * idle, p.Cost("b"), float64(idle) / 10, "active requests multiply the cost")
+
+	p.Finished("c", time.Millisecond, true)
+	assert.GreaterOrEqual(t, p.Cost("c"), 900 * time.Millisecond, "failures count as slow")
+}
+
+func TestPeakEWMAChoose(t *testing.T) {
+	servers := []string{"slow", "fast1", "fast2"}
+	p := NewPeakEWMA(time.Minute, 0)
+
+	// without measurements the hash spreads the clients
+	picked := map[string]int{}
+	for i := 0; i < 300; i++ {
+		picked[p.Choose(fmt.Sprint(i), servers)] += 1
+	}
+	assert.Len(t, picked, 3)
+
+	p.Finished("slow", 100 * time.Millisecond, false)
+	p.Finished("fast1", time.Millisecond, false)
+	p.Finished("fast2", time.Millisecond, false)
+
+	for i := 0; i < 300; i++ {
+		assert.NotEqual(t, "slow", p.Choose(fmt.Sprint(i), servers))
+	}
+
+	assert.Equal(t, "", p.Choose("client", nil))
+}
+
+func TestPeakEWMAAffinity(t *testing.T) {
+	servers := []string{"a", "b"}
+
+	loose := NewPeakEWMA(time.Minute, 0)
+	sticky := NewPeakEWMA(time.Minute, 3)
+
+	for _, p := range []*PeakEWMA{loose, sticky} {
+		p.Finished("a", 2 * time.Millisecond, false)
+		p.Finished("b", time.Millisecond, false)
+	}
+
+	onA := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+
+		assert.Equal(t, "b", loose.Choose(key, servers), "the hash only breaks ties")
+
+		if servers[Hash(key) % 2] == "a" {
+			onA += 1
+			assert.Equal(t, "a", sticky.Choose(key, servers), "clients stay while a is within 3 times the best")
+		}
+	}
+	assert.Positive(t, onA)
+
+	sticky.Finished("a", 10 * time.Millisecond, false)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "b", sticky.Choose(fmt.Sprint(i), servers), "clients leave a much slower server")
+	}
+}
+
+func TestBalancerObservesLatency(t *testing.T) {
+	slowHits := atomic.Int64{}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(rw, "slow")
+	}))
+	defer slow.Close()
+
+	fast := namedBackend("fast")
+	defer fast.Close()
+
+	b := New(
+		WithPool(NewPool(address(slow), address(fast))),
+		WithStrategy(NewPeakEWMA(time.Minute, 0)),
+	)
+
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.0.%d:4000", i)
+
+		b.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	assert.LessOrEqual(t, slowHits.Load(), int64(2), "the slow server is left once measured")
+}
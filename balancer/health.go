@@ -0,0 +1,172 @@
+package balancer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HealthChecker reports whether the server is able to take requests.
+type HealthChecker func(server string) bool
+
+// StateChange reports a target whose health check result changed. The first
+// result after a target is added is always reported.
+type StateChange struct {
+	Target string
+	Healthy bool
+	Time time.Time
+}
+
+const stateChangesBufferSize = 16
+
+// HealthMonitor checks every target on an interval from its own goroutine
+// between Start and Stop. Targets can be added and removed at any time.
+type HealthMonitor struct {
+	check HealthChecker
+	interval time.Duration
+
+	m sync.Mutex
+	ctx context.Context
+	cancel context.CancelFunc
+	targets map[string]context.CancelFunc
+	stopped bool
+
+	wg sync.WaitGroup
+	changes chan StateChange
+}
+
+func NewHealthMonitor(check HealthChecker, interval time.Duration) *HealthMonitor {
+	return &HealthMonitor{
+		check: check,
+		interval: interval,
+		targets: map[string]context.CancelFunc{},
+		changes: make(chan StateChange, stateChangesBufferSize),
+	}
+}
+
+// Changes returns the channel of state changes, closed once the monitor stops.
+func (h *HealthMonitor) Changes() <-chan StateChange {
+	return h.changes
+}
+
+// Start checks the targets until ctx is done or Stop is called.
+func (h *HealthMonitor) Start(ctx context.Context) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.ctx != nil || h.stopped {
+		return
+	}
+
+	h.ctx, h.cancel = context.WithCancel(ctx)
+
+	for target := range h.targets {
+		h.launch(target)
+	}
+
+	go func() {
+		<-h.ctx.Done()
+		h.Stop()
+	}()
+}
+
+// Stop ends the checks and waits for them to finish.
+func (h *HealthMonitor) Stop() {
+	h.m.Lock()
+
+	if h.stopped {
+		h.m.Unlock()
+		return
+	}
+
+	h.stopped = true
+	if h.cancel != nil {
+		h.cancel()
+	}
+
+	h.m.Unlock()
+
+	h.wg.Wait()
+	close(h.changes)
+}
+
+// Add starts checking the target. Adding a monitored target has no effect.
+func (h *HealthMonitor) Add(target string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if _, monitored := h.targets[target]; monitored || h.stopped {
+		return
+	}
+
+	h.targets[target] = nil
+
+	if h.ctx != nil {
+		h.launch(target)
+	}
+}
+
+// Remove stops checking the target.
+func (h *HealthMonitor) Remove(target string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if cancel := h.targets[target]; cancel != nil {
+		cancel()
+	}
+
+	delete(h.targets, target)
+}
+
+// Targets returns the monitored targets.
+func (h *HealthMonitor) Targets() []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	targets := make([]string, 0, len(h.targets))
+	for target := range h.targets {
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// launch has to be called with the monitor locked.
+func (h *HealthMonitor) launch(target string) {
+	ctx, cancel := context.WithCancel(h.ctx)
+	h.targets[target] = cancel
+
+	h.wg.Add(1)
+	go h.run(ctx, target)
+}
+
+func (h *HealthMonitor) run(ctx context.Context, target string) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	known, healthy := false, false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		alive := h.check(target)
+
+		if known && alive == healthy {
+			continue
+		}
+
+		known, healthy = true, alive
+
+		select {
+		case h.changes <- StateChange{Target: target, Healthy: alive, Time: time.Now()}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
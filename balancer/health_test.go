@@ -0,0 +1,122 @@
+package balancer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTargets struct {
+	m sync.Mutex
+	alive map[string]bool
+}
+
+func (f *fakeTargets) set(target string, alive bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.alive[target] = alive
+}
+
+func (f *fakeTargets) check(target string) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.alive[target]
+}
+
+func nextChange(t *testing.T, changes <-chan StateChange) StateChange {
+	t.Helper()
+
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(time.Second):
+		t.Fatal("no state change")
+		return StateChange{}
+	}
+}
+
+func TestHealthMonitorChanges(t *testing.T) {
+	targets := &fakeTargets{alive: map[string]bool{"a": true}}
+
+	monitor := NewHealthMonitor(targets.check, time.Millisecond)
+	monitor.Add("a")
+	monitor.Start(context.Background())
+	defer monitor.Stop()
+
+	change := nextChange(t, monitor.Changes())
+	assert.Equal(t, "a", change.Target)
+	assert.True(t, change.Healthy)
+
+	targets.set("a", false)
+	change = nextChange(t, monitor.Changes())
+	assert.Equal(t, "a", change.Target)
+	assert.False(t, change.Healthy)
+
+	targets.set("a", true)
+	assert.True(t, nextChange(t, monitor.Changes()).Healthy)
+}
+
+func TestHealthMonitorMembership(t *testing.T) {
+	targets := &fakeTargets{alive: map[string]bool{"a": true, "b": false}}
+
+	monitor := NewHealthMonitor(targets.check, time.Millisecond)
+	monitor.Start(context.Background())
+	defer monitor.Stop()
+
+	monitor.Add("b")
+	monitor.Add("b")
+	assert.Equal(t, []string{"b"}, monitor.Targets())
+
+	change := nextChange(t, monitor.Changes())
+	assert.Equal(t, "b", change.Target)
+	assert.False(t, change.Healthy)
+
+	monitor.Remove("b")
+	monitor.Add("a")
+	assert.Equal(t, []string{"a"}, monitor.Targets())
+
+	// b may have sent its result before it was removed, but not after
+	targets.set("b", true)
+	for change = nextChange(t, monitor.Changes()); change.Target != "a"; change = nextChange(t, monitor.Changes()) {
+		assert.False(t, change.Healthy)
+	}
+	assert.True(t, change.Healthy)
+}
+
+func TestHealthMonitorStop(t *testing.T) {
+	checks := make(chan string, 100)
+
+	monitor := NewHealthMonitor(func(target string) bool {
+		select {
+		case checks <- target:
+		default:
+		}
+		return true
+	}, time.Millisecond)
+	monitor.Add("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	monitor.Start(ctx)
+	<-checks
+
+	cancel()
+
+	// the changes channel is closed once every check has returned
+	for range monitor.Changes() {
+	}
+
+	for len(checks) > 0 {
+		<-checks
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, checks)
+
+	monitor.Add("b")
+	assert.Equal(t, []string{"a"}, monitor.Targets())
+
+	// stopping again is harmless
+	monitor.Stop()
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// poolSnapshot is an immutable list of the servers receiving traffic.
+type poolSnapshot struct {
+	servers []string
+}
+
+// Pool is the list of servers receiving traffic. A change replaces the whole
+// snapshot, so requests read the pool without locking and never see it half
+// updated.
+type Pool struct {
+	snapshot atomic.Pointer[poolSnapshot]
+	// m serializes the writers, readers never take it
+	m sync.Mutex
+}
+
+func NewPool(servers ...string) *Pool {
+	pool := &Pool{}
+	pool.snapshot.Store(&poolSnapshot{servers: slices.Clone(servers)})
+
+	return pool
+}
+
+// Servers returns the servers currently receiving traffic. The slice is
+// shared with other readers and must not be modified.
+func (p *Pool) Servers() []string {
+	return p.snapshot.Load().servers
+}
+
+// Set replaces the servers of the pool.
+func (p *Pool) Set(servers []string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.snapshot.Store(&poolSnapshot{servers: slices.Clone(servers)})
+}
+
+// Add appends the server to the pool unless it is already there.
+func (p *Pool) Add(server string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	servers := p.Servers()
+
+	if slices.Contains(servers, server) {
+		return false
+	}
+
+	p.snapshot.Store(&poolSnapshot{servers: append(slices.Clip(servers), server)})
+
+	return true
+}
+
+// Remove takes the server out of the pool if it is there.
+func (p *Pool) Remove(server string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	servers := p.Servers()
+
+	if !slices.Contains(servers, server) {
+		return false
+	}
+
+	p.snapshot.Store(&poolSnapshot{
+		servers: slices.DeleteFunc(slices.Clone(servers), func(s string) bool { return s == server }),
+	})
+
+	return true
+}
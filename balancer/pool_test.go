@@ -0,0 +1,28 @@
+package balancer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	servers := []string{"a:8080", "b:8080"}
+	pool := NewPool(servers...)
+
+	servers[0] = "changed:8080"
+	assert.Equal(t, []string{"a:8080", "b:8080"}, pool.Servers(), "the pool keeps its own copy")
+
+	snapshot := pool.Servers()
+
+	assert.True(t, pool.Add("c:8080"))
+	assert.False(t, pool.Add("c:8080"))
+	assert.True(t, pool.Remove("a:8080"))
+	assert.False(t, pool.Remove("a:8080"))
+
+	assert.Equal(t, []string{"b:8080", "c:8080"}, pool.Servers())
+	assert.Equal(t, []string{"a:8080", "b:8080"}, snapshot, "readers keep the snapshot they loaded")
+
+	pool.Set(nil)
+	assert.Empty(t, pool.Servers())
+}
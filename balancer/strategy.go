@@ -0,0 +1,54 @@
+package balancer
+
+import (
+	"crypto/sha512"
+	"hash/crc64"
+	"net/http"
+	"time"
+)
+
+// Strategy picks the server of the request among the healthy ones. An empty
+// result means no server can take the request.
+type Strategy interface {
+	Pick(r *http.Request, servers []string) string
+}
+
+// StrategyFunc adapts a function to the Strategy interface.
+type StrategyFunc func(r *http.Request, servers []string) string
+
+func (f StrategyFunc) Pick(r *http.Request, servers []string) string {
+	return f(r, servers)
+}
+
+// HashStrategy sends all the requests with the same key to the same server
+// while the pool does not change. The key is the client address by default.
+type HashStrategy struct {
+	Key func(r *http.Request) string
+}
+
+func (s HashStrategy) Pick(r *http.Request, servers []string) string {
+	if len(servers) == 0 {
+		return ""
+	}
+
+	key := r.RemoteAddr
+	if s.Key != nil {
+		key = s.Key(r)
+	}
+
+	return servers[Hash(key) % uint64(len(servers))]
+}
+
+var (
+	poly = uint64(time.Now().Unix())
+	table = crc64.MakeTable(poly)
+)
+
+// Hash spreads the keys evenly. The hashes are stable for the lifetime of
+// the process only.
+func Hash(str string) uint64 {
+	hasher := sha512.New()
+	hasher.Write([]byte(str))
+
+	return crc64.Checksum(hasher.Sum(nil), table)
+}
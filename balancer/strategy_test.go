@@ -0,0 +1,74 @@
+package balancer
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	maxRandStrSize = uint64(100)
+	HashTestsAmount = 100
+	HashTestsChecksAmount = 100
+)
+
+func randStr() string {
+	size := rand.Uint64() % (maxRandStrSize + 1)
+	str := ""
+
+	for i := uint64(0); i < size; i++ {
+		str += fmt.Sprintf("%c", rand.Int())
+	}
+
+	return str
+}
+
+func TestHash(t *testing.T) {
+	for i := 0; i < HashTestsAmount; i++ {
+		str := randStr()
+
+		h1 := Hash(str)
+		for i := 0; i < HashTestsChecksAmount; i++ {
+			h2 := Hash(str)
+
+			assert.Equal(t, h1, h2, "same hash for the same string")
+		}
+	}
+}
+
+func TestHashStrategy(t *testing.T) {
+	servers := []string{"a:8080", "b:8080", "c:8080"}
+	strategy := HashStrategy{}
+
+	assert.Equal(t, "", strategy.Pick(httptest.NewRequest("GET", "/", nil), nil))
+
+	picked := map[string]int{}
+
+	for i := 0; i < 300; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:4000", i / 256, i % 256)
+
+		server := strategy.Pick(r, servers)
+		assert.Equal(t, server, strategy.Pick(r, servers), "same server for the same client")
+
+		picked[server] += 1
+	}
+
+	assert.Len(t, picked, len(servers))
+
+	byUser := HashStrategy{Key: func(r *http.Request) string { return r.Header.Get("user") }}
+
+	r1 := httptest.NewRequest("GET", "/", nil)
+	r1.RemoteAddr = "10.0.0.1:4000"
+	r1.Header.Set("user", "alice")
+
+	r2 := httptest.NewRequest("GET", "/", nil)
+	r2.RemoteAddr = "10.0.0.2:4000"
+	r2.Header.Set("user", "alice")
+
+	assert.Equal(t, byUser.Pick(r1, servers), byUser.Pick(r2, servers))
+}
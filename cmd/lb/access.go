@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/magicvegetable/architecture-lab-4/iptools"
+)
+
+// AccessConfig lists the client networks allowed or denied. The most
+// specific network containing the client decides, and clients outside of
+// all of them are allowed only if there is no allow list.
+type AccessConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny []string `json:"deny,omitempty"`
+}
+
+type accessList struct {
+	rules iptools.Trie[bool]
+	hasAllow bool
+}
+
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		// a bare address is a network of its own
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * len(normalizeIP(ip))
+			return &net.IPNet{IP: normalizeIP(ip), Mask: net.CIDRMask(bits, bits)}, nil
+		}
+
+		return nil, err
+	}
+
+	return ipNet, nil
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+func compileAccess(config AccessConfig) (*accessList, error) {
+	if len(config.Allow) == 0 && len(config.Deny) == 0 {
+		return nil, nil
+	}
+
+	list := &accessList{hasAllow: len(config.Allow) > 0}
+
+	// deny entries are inserted last, so they win over the same allowed network
+	for _, entry := range []struct {
+		cidrs []string
+		allow bool
+	}{{config.Allow, true}, {config.Deny, false}} {
+		for _, cidr := range entry.cidrs {
+			ipNet, err := parseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := list.rules.Insert(ipNet, entry.allow); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return list, nil
+}
+
+func (a *accessList) allows(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+
+	if allowed, found := a.rules.Lookup(ip); found {
+		return allowed
+	}
+
+	return !a.hasAllow
+}
+
+// clientIP returns the address of the client, the one from the PROXY header
+// if the listener reads them.
+func clientIP(r *http.Request) net.IP {
+	return net.ParseIP(clientHost(r.RemoteAddr))
+}
+
+// clientHost identifies the client by its address without the port, so all
+// of its connections are treated alike.
+func clientHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// checkAccess applies the global access list and the one of the route.
+func checkAccess(rw http.ResponseWriter, r *http.Request) bool {
+	table := activeRoutes.Load()
+	ip := clientIP(r)
+
+	allowed := table.access.allows(ip)
+
+	if route := table.match(r); allowed && route != nil {
+		allowed = route.access.allows(ip)
+	}
+
+	if !allowed {
+		log.Printf("Denied %s access to %s", r.RemoteAddr, r.URL.Path)
+		writeError(rw, r, http.StatusForbidden, ReasonAccessDenied, "the client address is not allowed")
+	}
+
+	return allowed
+}
+
+// checkConnAccess applies the global access list to a connection of the TCP
+// mode, which has no routes.
+func checkConnAccess(conn net.Conn) bool {
+	if activeRoutes.Load().access.allows(net.ParseIP(clientHost(conn.RemoteAddr().String()))) {
+		return true
+	}
+
+	log.Printf("Denied %s access", conn.RemoteAddr())
+	return false
+}
+
+// SubnetPoolConfig sends the clients from the networks to the backends.
+type SubnetPoolConfig struct {
+	CIDRs []string `json:"cidrs"`
+	Backends []string `json:"backends"`
+}
+
+var activeSubnetPools atomic.Pointer[iptools.Trie[[]string]]
+
+func init() {
+	activeSubnetPools.Store(&iptools.Trie[[]string]{})
+}
+
+func compileSubnetPools(pools []SubnetPoolConfig) (*iptools.Trie[[]string], error) {
+	trie := &iptools.Trie[[]string]{}
+
+	for _, pool := range pools {
+		if len(pool.Backends) == 0 {
+			return nil, fmt.Errorf("subnet pool %v without backends", pool.CIDRs)
+		}
+
+		for _, address := range pool.Backends {
+			if _, known := Backends[address]; !known {
+				return nil, fmt.Errorf("subnet pool %v: unknown backend %s", pool.CIDRs, address)
+			}
+		}
+
+		for _, cidr := range pool.CIDRs {
+			ipNet, err := parseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := trie.Insert(ipNet, pool.Backends); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return trie, nil
+}
+
+func setSubnetPools(pools []SubnetPoolConfig) error {
+	trie, err := compileSubnetPools(pools)
+	if err != nil {
+		return err
+	}
+
+	activeSubnetPools.Store(trie)
+
+	return nil
+}
+
+// subnetCandidates narrows the pool down to the healthy backends serving
+// the client network. Clients outside of the subnet pools, or whose
+// backends are all down, keep the whole pool.
+func subnetCandidates(addr string, pool []string) ([]string, bool) {
+	backends, found := activeSubnetPools.Load().Lookup(net.ParseIP(clientHost(addr)))
+	if !found {
+		return pool, false
+	}
+
+	var healthy []string
+	for _, server := range pool {
+		for _, backend := range backends {
+			if server == backend {
+				healthy = append(healthy, server)
+			}
+		}
+	}
+
+	if len(healthy) == 0 {
+		return pool, false
+	}
+
+	return healthy, true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessList(t *testing.T) {
+	list, err := compileAccess(AccessConfig{
+		Allow: []string{"10.0.0.0/8", "fd00::/8", "192.168.1.0/24"},
+		Deny: []string{"10.66.0.0/16", "192.168.1.0/24"},
+	})
+	assert.Nil(t, err)
+
+	cases := map[string]bool{
+		"10.1.2.3": true,
+		"10.66.0.1": false,
+		"192.168.1.5": false,
+		"fd00::1": true,
+		"2001:db8::1": false,
+		"172.16.0.1": false,
+	}
+
+	for ip, allowed := range cases {
+		assert.Equal(t, allowed, list.allows(net.ParseIP(ip)), ip)
+	}
+
+	denyOnly, err := compileAccess(AccessConfig{Deny: []string{"203.0.113.7"}})
+	assert.Nil(t, err)
+	assert.False(t, denyOnly.allows(net.ParseIP("203.0.113.7")))
+	assert.True(t, denyOnly.allows(net.ParseIP("203.0.113.8")), "clients are allowed without an allow list")
+
+	_, err = compileAccess(AccessConfig{Allow: []string{"10.0.0.0/33"}})
+	assert.NotNil(t, err)
+}
+
+func TestCheckAccess(t *testing.T) {
+	backend := httpEchoBackend()
+	defer backend.Close()
+
+	withPool(t, backend.Listener.Addr().String())
+
+	assert.Nil(t, setRoutes(
+		AccessConfig{Deny: []string{"198.51.100.0/24"}},
+		[]RouteConfig{{Name: "admin", PathPrefix: "/admin/", Access: AccessConfig{Allow: []string{"10.0.0.0/8"}}}},
+	))
+	t.Cleanup(func() { _ = setRoutes(AccessConfig{}, nil) })
+
+	request := func(path, remoteAddr string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+
+		rw := httptest.NewRecorder()
+		httpBalancer.Load().ServeHTTP(rw, r)
+
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/api/v1/some-data", "192.0.2.1:4000"))
+	assert.Equal(t, http.StatusForbidden, request("/api/v1/some-data", "198.51.100.9:4000"), "global deny list")
+	assert.Equal(t, http.StatusOK, request("/admin/stats", "10.0.0.1:4000"))
+	assert.Equal(t, http.StatusForbidden, request("/admin/stats", "192.0.2.1:4000"), "route allow list")
+}
+
+func TestSubnetPools(t *testing.T) {
+	withPool(t, "internal:8080", "public1:8080", "public2:8080")
+
+	assert.Nil(t, setSubnetPools([]SubnetPoolConfig{
+		{CIDRs: []string{"10.0.0.0/8", "fd00::/8"}, Backends: []string{"internal:8080"}},
+	}))
+	t.Cleanup(func() { _ = setSubnetPools(nil) })
+
+	assert.Equal(t, "internal:8080", GetAvailableServer("10.20.30.40:5000"))
+	assert.Equal(t, "internal:8080", GetAvailableServer("[fd00::7]:5000"))
+
+	outside := map[string]int{}
+	for i := 0; i < 100; i++ {
+		outside[GetAvailableServer(net.JoinHostPort(net.IPv4(192, 0, 2, byte(i)).String(), "5000"))] += 1
+	}
+	assert.Len(t, outside, 3, "clients outside of the subnet pools use the whole pool")
+
+	Backends["internal:8080"].Transition(StateUnhealthy, StateHealthy)
+
+	assert.Contains(t, []string{"public1:8080", "public2:8080"}, GetAvailableServer("10.20.30.40:5000"),
+		"clients of a pool without healthy backends use the whole pool")
+
+	_, err := compileSubnetPools([]SubnetPoolConfig{{CIDRs: []string{"10.0.0.0/8"}, Backends: []string{"unknown:8080"}}})
+	assert.NotNil(t, err)
+}
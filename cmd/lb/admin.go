@@ -0,0 +1,233 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/httptools"
+)
+
+var (
+	adminPort = flag.Int("admin-port", 8091, "load balancer admin port")
+	// the admin API changes the balancer without any authentication
+	adminAddr = flag.String("admin-addr", "127.0.0.1", "address the admin server listens on, empty for every interface")
+)
+
+type backendInfo struct {
+	Address string `json:"address"`
+	State BackendState `json:"state"`
+	Since time.Time `json:"since"`
+	InFlight int64 `json:"in_flight"`
+	Weight float64 `json:"weight"`
+	Load *httptools.Load `json:"load"`
+	ExpectedLatencyMs float64 `json:"expected_latency_ms"`
+
+	LastCheck *time.Time `json:"last_check"`
+	LastCheckOK bool `json:"last_check_ok"`
+	LastCheckLatencyMs float64 `json:"last_check_latency_ms"`
+	RequestRate float64 `json:"request_rate"`
+	ErrorRate float64 `json:"error_rate"`
+	LastDied *time.Time `json:"last_died"`
+	LastResurrected *time.Time `json:"last_resurrected"`
+}
+
+// statusRateWindowSec is the window request and error rates are averaged over.
+const statusRateWindowSec = 10
+
+func backendsInfo() []backendInfo {
+	now := time.Now()
+	infos := []backendInfo{}
+
+	for _, backend := range Backends {
+		metrics := &backend.metrics
+
+		infos = append(infos, backendInfo{
+			Address: backend.Address,
+			State: backend.State(),
+			Since: backend.Since(),
+			InFlight: backend.InFlight(),
+			Weight: backend.effectiveWeight(now),
+			Load: backend.Load(),
+			ExpectedLatencyMs: float64(latencyStrategy.Cost(backend.Address)) / float64(time.Millisecond),
+
+			LastCheck: unixNanoTime(metrics.lastCheck.Load()),
+			LastCheckOK: metrics.lastCheckOK.Load(),
+			LastCheckLatencyMs: float64(metrics.lastCheckLatency.Load()) / float64(time.Millisecond),
+			RequestRate: metrics.requests.Rate(now, statusRateWindowSec),
+			ErrorRate: metrics.errors.Rate(now, statusRateWindowSec),
+			LastDied: unixNanoTime(metrics.lastDied.Load()),
+			LastResurrected: unixNanoTime(metrics.lastResurrected.Load()),
+		})
+	}
+
+	slices.SortFunc(infos, func(a, b backendInfo) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return infos
+}
+
+type statusInfo struct {
+	Time time.Time `json:"time"`
+	Mode string `json:"mode"`
+	PoolSize int `json:"pool_size"`
+	Panic bool `json:"panic"`
+	Backends []backendInfo `json:"backends"`
+}
+
+//go:embed status.html
+var statusPage []byte
+
+func writeJSON(rw http.ResponseWriter, status int, value any) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(value)
+}
+
+// backendAction changes the state of the backend named in the request path.
+func backendAction(to BackendState, from ...BackendState) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		address := r.PathValue("address")
+		backend, known := Backends[address]
+
+		if !known {
+			http.Error(rw, "unknown backend " + address, http.StatusNotFound)
+			return
+		}
+
+		previous := backend.State()
+
+		if !backend.Transition(to, from...) {
+			http.Error(rw, "backend " + address + " is " + previous.String(), http.StatusConflict)
+			return
+		}
+
+		log.Printf("%v %v -> %v\n", address, previous, to)
+
+		writeJSON(rw, http.StatusOK, backendsInfo())
+	}
+}
+
+func adminHandler() http.Handler {
+	h := new(http.ServeMux)
+
+	h.HandleFunc("GET /backends", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, backendsInfo())
+	})
+
+	h.HandleFunc("GET /status", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "text/html; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(statusPage)
+	})
+
+	h.HandleFunc("GET /status.json", func(rw http.ResponseWriter, r *http.Request) {
+		_, panicked := panicPool(ServersPool())
+
+		writeJSON(rw, http.StatusOK, statusInfo{
+			Time: time.Now(),
+			Mode: *mode,
+			PoolSize: len(ServersPool()),
+			Panic: panicked,
+			Backends: backendsInfo(),
+		})
+	})
+
+	h.HandleFunc("GET /events", serveEvents)
+
+	h.HandleFunc("GET /ready", serveReady)
+	h.HandleFunc("GET /healthz", serveHealthz)
+
+	h.HandleFunc("POST /config/reload", func(rw http.ResponseWriter, r *http.Request) {
+		if err := reloadConfig(); err != nil {
+			http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, currentConfig.Load())
+	})
+
+	h.HandleFunc("GET /versions", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, versionsInfo())
+	})
+
+	h.HandleFunc("GET /priorities", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, prioritiesInfo())
+	})
+
+	h.HandleFunc("GET /affinities", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, affinitiesInfo{
+			Size: *affinitySize,
+			TTL: Duration(*affinityTTL),
+			Entries: affinities.Entries(time.Now()),
+		})
+	})
+
+	// the clients forgotten here are spread over the pool on their next
+	// request, all of them or only the ones of the backend in the query
+	h.HandleFunc("DELETE /affinities", func(rw http.ResponseWriter, r *http.Request) {
+		backend := r.URL.Query().Get("backend")
+		flushed := affinities.Flush(backend)
+		log.Printf("Flushed %d client affinities", flushed)
+
+		writeJSON(rw, http.StatusOK, map[string]int{"flushed": flushed})
+	})
+
+	h.HandleFunc("GET /faults", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, activeFaults.Load().rules)
+	})
+
+	// the rules set here stay active until the next config reload
+	h.HandleFunc("PUT /faults", func(rw http.ResponseWriter, r *http.Request) {
+		var rules []FaultRule
+
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := setFaults(rules); err != nil {
+			http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, activeFaults.Load().rules)
+	})
+
+	h.HandleFunc("DELETE /faults", func(rw http.ResponseWriter, r *http.Request) {
+		_ = setFaults(nil)
+		log.Println("Fault injection disabled")
+
+		writeJSON(rw, http.StatusOK, activeFaults.Load().rules)
+	})
+
+	h.HandleFunc(
+		"POST /backends/{address}/drain",
+		backendAction(StateDraining, StateHealthy, StateUnhealthy),
+	)
+	h.HandleFunc(
+		"POST /backends/{address}/maintenance",
+		backendAction(StateMaintenance, StateHealthy, StateUnhealthy, StateDraining),
+	)
+	// the backend might have died while drained or in maintenance, so it has
+	// to pass a health check before it rejoins the pool
+	h.HandleFunc(
+		"POST /backends/{address}/enable",
+		backendAction(StateUnhealthy, StateMaintenance, StateDraining),
+	)
+
+	return h
+}
+
+func startAdmin() httptools.Server {
+	admin := httptools.CreateServerAt(*adminAddr, *adminPort, adminHandler())
+	admin.Start()
+
+	return admin
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	affinityTTL = flag.Duration("affinity-ttl", 10 * time.Minute, "time a client keeps its backend without sending requests with the affinity strategy")
+	affinitySize = flag.Int("affinity-size", 100000, "maximal amount of clients remembered by the affinity strategy, the least recently seen ones are forgotten first")
+	affinitySnapshot = flag.String("affinity-snapshot", "", "file the affinity table is saved to and restored from on restart, empty to keep it in memory only")
+	affinitySnapshotInterval = flag.Duration("affinity-snapshot-interval", time.Minute, "interval between the saves of the affinity table")
+)
+
+func affine() bool {
+	return *strategy == "affinity"
+}
+
+type affinityEntry struct {
+	Client string `json:"client"`
+	Backend string `json:"backend"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// affinityTable remembers the backend of every client seen within the
+// affinity TTL, up to the affinity size. Its list is ordered from the most
+// recently seen client.
+type affinityTable struct {
+	m sync.Mutex
+	entries map[string]*list.Element
+	order *list.List
+}
+
+// affinities is the table of the affinity strategy.
+var affinities = newAffinityTable()
+
+func newAffinityTable() *affinityTable {
+	return &affinityTable{entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// Lookup returns the backend of the client, refreshing its last use.
+func (t *affinityTable) Lookup(client string, now time.Time) (string, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	element, known := t.entries[client]
+	if !known {
+		return "", false
+	}
+
+	entry := element.Value.(*affinityEntry)
+
+	if now.Sub(entry.LastSeen) > *affinityTTL {
+		t.remove(element)
+		return "", false
+	}
+
+	entry.LastSeen = now
+	t.order.MoveToFront(element)
+
+	return entry.Backend, true
+}
+
+// Assign binds the client to the backend, forgetting the least recently
+// seen client if the table is full.
+func (t *affinityTable) Assign(client, backend string, now time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.assign(affinityEntry{Client: client, Backend: backend, LastSeen: now})
+}
+
+// assign has to be called with the table locked.
+func (t *affinityTable) assign(entry affinityEntry) {
+	if element, known := t.entries[entry.Client]; known {
+		element.Value = &entry
+		t.order.MoveToFront(element)
+		return
+	}
+
+	for t.order.Len() > 0 && t.order.Len() >= *affinitySize {
+		t.remove(t.order.Back())
+	}
+
+	if *affinitySize > 0 {
+		t.entries[entry.Client] = t.order.PushFront(&entry)
+	}
+}
+
+func (t *affinityTable) remove(element *list.Element) {
+	delete(t.entries, element.Value.(*affinityEntry).Client)
+	t.order.Remove(element)
+}
+
+// Entries lists the clients not idle for longer than the TTL, the most
+// recently seen first.
+func (t *affinityTable) Entries(now time.Time) []affinityEntry {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	entries := []affinityEntry{}
+
+	for element := t.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*affinityEntry)
+
+		if now.Sub(entry.LastSeen) > *affinityTTL {
+			break
+		}
+
+		entries = append(entries, *entry)
+	}
+
+	return entries
+}
+
+// Flush forgets the clients of the backend, or every client if it is
+// empty, and returns how many were forgotten.
+func (t *affinityTable) Flush(backend string) int {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	flushed := 0
+
+	for element := t.order.Front(); element != nil; {
+		next := element.Next()
+
+		if backend == "" || element.Value.(*affinityEntry).Backend == backend {
+			t.remove(element)
+			flushed += 1
+		}
+
+		element = next
+	}
+
+	return flushed
+}
+
+// Save writes the live entries to the file, through a temporary one so a
+// crash never leaves half of a snapshot.
+func (t *affinityTable) Save(path string, now time.Time) error {
+	data, err := json.Marshal(t.Entries(now))
+	if err != nil {
+		return fmt.Errorf("encode affinity snapshot: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("write affinity snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("write affinity snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// Restore adds the entries of the snapshot that did not expire since it was
+// saved. A missing snapshot restores nothing.
+func (t *affinityTable) Restore(path string, now time.Time) (int, error) {
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("read affinity snapshot: %w", err)
+	}
+
+	var entries []affinityEntry
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("parse affinity snapshot %s: %w", path, err)
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	restored := 0
+
+	// the snapshot starts with the most recent clients, which have to end up
+	// in front of the list
+	for i := len(entries) - 1; i >= 0; i-- {
+		if now.Sub(entries[i].LastSeen) <= *affinityTTL {
+			t.assign(entries[i])
+			restored += 1
+		}
+	}
+
+	return restored, nil
+}
+
+// startAffinitySnapshots restores the table from the file and saves it there
+// on the interval. The returned function saves it a last time and stops.
+func startAffinitySnapshots(path string, interval time.Duration) func() {
+	restored, err := affinities.Restore(path, time.Now())
+	if err != nil {
+		log.Printf("Failed to restore affinities: %s", err)
+	}
+	log.Printf("Restored %d client affinities", restored)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				saveAffinities(path)
+			case <-stop:
+				saveAffinities(path)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func saveAffinities(path string) {
+	if err := affinities.Save(path, time.Now()); err != nil {
+		log.Printf("Failed to save affinities: %s", err)
+	}
+}
+
+// affineServer keeps the client on the backend it was given while it stays
+// among the candidates, and hashes the new clients to one of them.
+func affineServer(addr string, candidates []string, now time.Time) string {
+	client := clientHost(addr)
+
+	if server, known := affinities.Lookup(client, now); known && slices.Contains(candidates, server) {
+		return server
+	}
+
+	server := hashedServer(client, candidates, now)
+	affinities.Assign(client, server, now)
+
+	return server
+}
+
+type affinitiesInfo struct {
+	Size int `json:"size"`
+	TTL Duration `json:"ttl"`
+	Entries []affinityEntry `json:"entries"`
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withAffinity(t *testing.T, size int, ttl time.Duration) {
+	savedStrategy, savedTable := *strategy, affinities
+	savedSize, savedTTL, savedSlowStart := *affinitySize, *affinityTTL, *slowStart
+
+	*strategy = "affinity"
+	affinities = newAffinityTable()
+	*affinitySize, *affinityTTL, *slowStart = size, ttl, 0
+
+	t.Cleanup(func() {
+		*strategy, affinities = savedStrategy, savedTable
+		*affinitySize, *affinityTTL, *slowStart = savedSize, savedTTL, savedSlowStart
+	})
+}
+
+func clientBackends(subnet string, clients int) map[string]string {
+	res := map[string]string{}
+
+	for i := 0; i < clients; i++ {
+		client := fmt.Sprintf("%s.%d.%d", subnet, i / 256, i % 256)
+		res[client] = GetAvailableServer(fmt.Sprintf("%s:%d", client, 4000 + i))
+	}
+
+	return res
+}
+
+func TestAffinityKeepsClients(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	withAffinity(t, 10000, time.Minute)
+
+	before := clientBackends("10.0", 300)
+	assert.Equal(t, before, clientBackends("10.0", 300), "clients keep their backend over new connections")
+
+	Backends["c:8080"] = newBackend("c:8080")
+	pool.Add("c:8080")
+
+	assert.Equal(t, before, clientBackends("10.0", 300), "known clients stay where they were")
+
+	res := map[string]int{}
+	for _, server := range clientBackends("10.1", 300) {
+		res[server] += 1
+	}
+	assert.Greater(t, res["c:8080"], 50, "new clients are spread over the new pool")
+
+	pool.Remove("a:8080")
+
+	after := clientBackends("10.0", 300)
+	for client, server := range before {
+		if server == "a:8080" {
+			assert.NotEqual(t, "a:8080", after[client])
+		} else {
+			assert.Equal(t, server, after[client], "clients of healthy backends do not move")
+		}
+	}
+}
+
+func TestAffinityTableBounds(t *testing.T) {
+	withAffinity(t, 2, time.Minute)
+	now := time.Now()
+
+	affinities.Assign("10.0.0.1", "a:8080", now)
+	affinities.Assign("10.0.0.2", "b:8080", now)
+
+	_, known := affinities.Lookup("10.0.0.1", now)
+	assert.True(t, known)
+
+	affinities.Assign("10.0.0.3", "a:8080", now)
+
+	_, known = affinities.Lookup("10.0.0.2", now)
+	assert.False(t, known, "the least recently seen client is forgotten")
+	assert.Len(t, affinities.Entries(now), 2)
+
+	server, known := affinities.Lookup("10.0.0.1", now.Add(30 * time.Second))
+	assert.True(t, known)
+	assert.Equal(t, "a:8080", server)
+
+	_, known = affinities.Lookup("10.0.0.3", now.Add(90 * time.Second))
+	assert.False(t, known, "idle clients expire")
+	assert.Equal(t, []affinityEntry{
+		{Client: "10.0.0.1", Backend: "a:8080", LastSeen: now.Add(30 * time.Second)},
+	}, affinities.Entries(now.Add(time.Minute)))
+}
+
+func TestAffinitySnapshot(t *testing.T) {
+	withAffinity(t, 10, time.Minute)
+	path := filepath.Join(t.TempDir(), "affinities.json")
+	now := time.Now().Truncate(time.Second)
+
+	affinities.Assign("10.0.0.1", "a:8080", now.Add(-50 * time.Second))
+	affinities.Assign("10.0.0.2", "b:8080", now.Add(-10 * time.Second))
+	assert.Nil(t, affinities.Save(path, now))
+
+	restored := newAffinityTable()
+
+	count, err := restored.Restore(path, now.Add(20 * time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count, "entries expired since the snapshot are dropped")
+
+	server, known := restored.Lookup("10.0.0.2", now.Add(20 * time.Second))
+	assert.True(t, known)
+	assert.Equal(t, "b:8080", server)
+
+	count, err = newAffinityTable().Restore(filepath.Join(t.TempDir(), "missing.json"), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestAdminAffinities(t *testing.T) {
+	withAffinity(t, 10, time.Minute)
+	now := time.Now()
+
+	affinities.Assign("10.0.0.1", "a:8080", now)
+	affinities.Assign("10.0.0.2", "b:8080", now)
+	affinities.Assign("10.0.0.3", "a:8080", now)
+
+	h := adminHandler()
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/affinities", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	info := affinitiesInfo{}
+	assert.Nil(t, json.NewDecoder(rw.Body).Decode(&info))
+	assert.Equal(t, 10, info.Size)
+	assert.Len(t, info.Entries, 3)
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("DELETE", "/affinities?backend=a:8080", nil))
+	assert.JSONEq(t, `{"flushed": 2}`, rw.Body.String())
+	assert.Len(t, affinities.Entries(now), 1)
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("DELETE", "/affinities", nil))
+	assert.JSONEq(t, `{"flushed": 1}`, rw.Body.String())
+	assert.Empty(t, affinities.Entries(now))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+)
+
+var slowStart = flag.Duration("slow-start", 30 * time.Second, "time for a returning backend to ramp up to its full traffic share, 0 to disable")
+
+type BackendState int32
+
+const (
+	StateHealthy BackendState = iota
+	StateUnhealthy
+	StateDraining
+	StateMaintenance
+)
+
+var stateNames = map[BackendState]string{
+	StateHealthy:     "healthy",
+	StateUnhealthy:   "unhealthy",
+	StateDraining:    "draining",
+	StateMaintenance: "maintenance",
+}
+
+func (s BackendState) String() string {
+	return stateNames[s]
+}
+
+func (s BackendState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *BackendState) UnmarshalJSON(data []byte) error {
+	var name string
+
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+
+	for state, stateName := range stateNames {
+		if stateName == name {
+			*s = state
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown backend state %#v", name)
+}
+
+type Backend struct {
+	Address string
+
+	state atomic.Int32
+	since atomic.Int64
+	rampStart atomic.Int64
+	inFlight atomic.Int64
+	load atomic.Pointer[backendLoad]
+
+	clientOnce sync.Once
+	client *http.Client
+
+	metrics backendMetrics
+}
+
+// Backends holds every configured backend, including the ones currently
+// excluded from the pool. The map is filled once at startup.
+var Backends = map[string]*Backend{}
+
+func init() {
+	for _, server := range DefaultServers {
+		Backends[server] = newBackend(server)
+	}
+}
+
+func newBackend(address string) *Backend {
+	b := &Backend{Address: address}
+	b.since.Store(time.Now().UnixNano())
+
+	return b
+}
+
+func (b *Backend) State() BackendState {
+	return BackendState(b.state.Load())
+}
+
+func (b *Backend) Since() time.Time {
+	return time.Unix(0, b.since.Load())
+}
+
+func (b *Backend) InFlight() int64 {
+	return b.inFlight.Load()
+}
+
+// Transition moves the backend from one of the given states to the target
+// one and keeps the pool in sync. It reports whether the state changed.
+func (b *Backend) Transition(to BackendState, from ...BackendState) bool {
+	previous, changed := b.transition(to, from)
+
+	if changed {
+		events.Publish(Event{
+			Type: transitionEvent(previous, to),
+			Backend: b.Address,
+			From: previous.String(),
+			To: to.String(),
+		})
+	}
+
+	if changed && to == StateDraining && b.InFlight() == 0 {
+		b.drained()
+	}
+
+	// backends in maintenance are not checked, and the first check after it
+	// decides whether they rejoin the pool. The monitor only reports changes
+	// of the check results, so an enabled draining backend is checked anew
+	// too, or a backend dying while drained would never be reported.
+	if monitor := httpBalancer.Load().Monitor(); changed && monitor != nil {
+		if to == StateMaintenance {
+			monitor.Remove(b.Address)
+		} else if previous == StateMaintenance {
+			monitor.Add(b.Address)
+		} else if previous == StateDraining && to == StateUnhealthy {
+			monitor.Remove(b.Address)
+			monitor.Add(b.Address)
+		}
+	}
+
+	return changed
+}
+
+func (b *Backend) transition(to BackendState, from []BackendState) (BackendState, bool) {
+	serversM.Lock()
+	defer serversM.Unlock()
+
+	current := b.State()
+
+	if current == to || !slices.Contains(from, current) {
+		return current, false
+	}
+
+	b.state.Store(int32(to))
+	b.since.Store(time.Now().UnixNano())
+
+	if current == StateHealthy {
+		pool.Remove(b.Address)
+	}
+
+	if to == StateHealthy {
+		b.rampStart.Store(time.Now().UnixNano())
+
+		pool.Add(b.Address)
+	}
+
+	return current, true
+}
+
+// rampWeight is the share of its hashed traffic the backend accepts while
+// it slowly starts after coming back to the pool.
+func (b *Backend) rampWeight(now time.Time) float64 {
+	start := b.rampStart.Load()
+
+	if start == 0 || *slowStart <= 0 {
+		return 1
+	}
+
+	elapsed := now.Sub(time.Unix(0, start))
+
+	if elapsed >= *slowStart {
+		return 1
+	}
+
+	if elapsed < 0 {
+		return 0
+	}
+
+	return float64(elapsed) / float64(*slowStart)
+}
+
+const rampResolution = 10000
+
+// acceptsKey decides deterministically whether a client key belongs to the
+// part of traffic a ramping or loaded backend takes.
+func (b *Backend) acceptsKey(key string, now time.Time) bool {
+	weight := b.effectiveWeight(now)
+
+	if weight >= 1 {
+		return true
+	}
+
+	threshold := uint64(weight * rampResolution)
+
+	return balancer.Hash(key + "#slow-start") % rampResolution < threshold
+}
+
+func (b *Backend) startRequest() {
+	b.inFlight.Add(1)
+}
+
+func (b *Backend) finishRequest() {
+	if b.inFlight.Add(-1) == 0 && b.State() == StateDraining {
+		b.drained()
+	}
+}
+
+func (b *Backend) drained() {
+	log.Printf("%v drained\n", b.Address)
+	events.Publish(Event{Type: EventDrained, Backend: b.Address})
+}
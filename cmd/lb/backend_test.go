@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const lifecycleClientsAmount = 10000
+
+// withPool replaces the pool with fresh backends for the duration of a test.
+func withPool(t testing.TB, servers ...string) {
+	savedPool := ServersPool()
+	savedBackends := Backends
+
+	pool.Set(servers)
+	Backends = map[string]*Backend{}
+
+	for _, server := range servers {
+		Backends[server] = newBackend(server)
+	}
+
+	t.Cleanup(func() {
+		pool.Set(savedPool)
+		Backends = savedBackends
+	})
+}
+
+// withFlag sets a flag, or any other setting, for the duration of a test.
+func withFlag[T any](t testing.TB, flag *T, value T) {
+	saved := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = saved })
+}
+
+func withSlowStart(t testing.TB, slowStartDuration time.Duration) {
+	withFlag(t, slowStart, slowStartDuration)
+}
+
+func shares(clients int) map[string]int {
+	res := map[string]int{}
+
+	for i := 0; i < clients; i++ {
+		res[GetAvailableServer(fmt.Sprintf("10.0.%d.%d:4000", i / 256, i % 256))] += 1
+	}
+
+	return res
+}
+
+func TestBackendTransition(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	backend := Backends["a:8080"]
+
+	assert.False(t, backend.Transition(StateHealthy, StateUnhealthy), "already healthy")
+
+	assert.True(t, backend.Transition(StateDraining, StateHealthy))
+	assert.Equal(t, StateDraining, backend.State())
+	assert.NotContains(t, ServersPool(), "a:8080", "draining backend gets no new clients")
+
+	assert.False(t, backend.Transition(StateHealthy, StateUnhealthy), "health monitor does not undrain")
+
+	assert.True(t, backend.Transition(StateHealthy, StateDraining))
+	assert.Contains(t, ServersPool(), "a:8080")
+}
+
+func TestSlowStart(t *testing.T) {
+	withPool(t, "a:8080", "b:8080", "c:8080")
+	withSlowStart(t, time.Minute)
+
+	backend := Backends["c:8080"]
+	backend.Transition(StateUnhealthy, StateHealthy)
+	backend.Transition(StateHealthy, StateUnhealthy)
+
+	backend.rampStart.Store(time.Now().UnixNano())
+	assert.LessOrEqual(t, shares(lifecycleClientsAmount)["c:8080"], lifecycleClientsAmount / 100, "just resurrected backend barely takes clients")
+
+	backend.rampStart.Store(time.Now().Add(-*slowStart / 2).UnixNano())
+	half := shares(lifecycleClientsAmount)["c:8080"]
+	assert.InDelta(t, lifecycleClientsAmount / 6, half, lifecycleClientsAmount / 30, "half of the full share in the middle of the ramp")
+
+	backend.rampStart.Store(time.Now().Add(-*slowStart).UnixNano())
+	full := shares(lifecycleClientsAmount)["c:8080"]
+	assert.InDelta(t, lifecycleClientsAmount / 3, full, lifecycleClientsAmount / 30, "full share after the ramp")
+}
+
+func TestSlowStartIsSticky(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	withSlowStart(t, time.Minute)
+
+	backend := Backends["b:8080"]
+	backend.Transition(StateUnhealthy, StateHealthy)
+	backend.Transition(StateHealthy, StateUnhealthy)
+
+	// a client hashed to the ramping backend once it takes its full share
+	addr := ""
+	backend.rampStart.Store(0)
+
+	for i := 0; GetAvailableServer(addr) != "b:8080"; i++ {
+		addr = fmt.Sprintf("10.1.1.%d:4000", i)
+	}
+
+	taken := false
+
+	for elapsed := time.Duration(0); elapsed <= *slowStart; elapsed += time.Second {
+		backend.rampStart.Store(time.Now().Add(-elapsed).UnixNano())
+		server := GetAvailableServer(addr)
+
+		if taken {
+			assert.Equal(t, "b:8080", server, "client stays once taken")
+		}
+
+		taken = taken || server == "b:8080"
+	}
+
+	assert.True(t, taken, "client is taken by the end of the ramp")
+}
+
+func TestAdminBackendActions(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	admin := adminHandler()
+
+	post := func(path string) int {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, post("/backends/x:8080/drain"))
+
+	assert.Equal(t, http.StatusOK, post("/backends/a:8080/maintenance"))
+	assert.Equal(t, StateMaintenance, Backends["a:8080"].State())
+	assert.NotContains(t, ServersPool(), "a:8080")
+
+	assert.Equal(t, http.StatusOK, post("/backends/a:8080/enable"))
+	assert.Equal(t, StateUnhealthy, Backends["a:8080"].State(), "has to pass a health check first")
+
+	assert.Equal(t, http.StatusOK, post("/backends/b:8080/drain"))
+	assert.Equal(t, http.StatusConflict, post("/backends/b:8080/drain"))
+	assert.Equal(t, http.StatusOK, post("/backends/b:8080/enable"))
+	assert.Equal(t, StateUnhealthy, Backends["b:8080"].State(), "drained backend is checked again")
+}
+
+func TestEnableDeadDrainedBackend(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	withAlive(t, "a:8080", "b:8080")
+	withFlag(t, &CheckServerHealthInterval, time.Millisecond)
+
+	monitorServers(t, HealthMock)
+
+	backend := Backends["a:8080"]
+	assert.True(t, backend.Transition(StateDraining, StateHealthy))
+
+	// the backend restarts while drained and fails its checks
+	killServer("a:8080")
+	time.Sleep(20 * time.Millisecond)
+
+	assert.True(t, backend.Transition(StateUnhealthy, StateDraining))
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Equal(t, StateUnhealthy, backend.State(), "dead backend is not enabled")
+	assert.NotContains(t, ServersPool(), "a:8080")
+
+	resurrectServer("a:8080")
+	assert.Eventually(t, func() bool { return backend.State() == StateHealthy }, time.Second, time.Millisecond)
+	assert.Contains(t, ServersPool(), "a:8080")
+
+	alive := Backends["b:8080"]
+	assert.True(t, alive.Transition(StateDraining, StateHealthy))
+	assert.True(t, alive.Transition(StateUnhealthy, StateDraining))
+	assert.Eventually(t, func() bool { return alive.State() == StateHealthy }, time.Second, time.Millisecond, "live drained backend rejoins after a check")
+}
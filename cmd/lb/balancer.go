@@ -8,11 +8,14 @@ import (
 	"log"
 	"net/http"
 	"time"
-	"crypto/sha512"
-	"hash/crc64"
-	"sync"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"slices"
+	"strings"
+	"sync/atomic"
 
+	"github.com/magicvegetable/architecture-lab-4/balancer"
 	"github.com/magicvegetable/architecture-lab-4/httptools"
 	"github.com/magicvegetable/architecture-lab-4/signal"
 )
@@ -23,20 +26,11 @@ var (
 	https = flag.Bool("https", false, "whether backends support HTTPs")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 15 * time.Second, "time to wait for active requests on shutdown")
 
-	serversM = sync.Mutex{}
 	CheckServerHealthInterval = 1 * time.Second
 )
 
-var (
-	timeout = time.Duration(*timeoutSec) * time.Second
-	ServersPool = []string{
-		"server1:8080",
-		"server2:8080",
-		"server3:8080",
-	}
-)
-
 func scheme() string {
 	if *https {
 		return "https"
@@ -45,115 +39,327 @@ func scheme() string {
 }
 
 func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*timeoutSec) * time.Second)
+	defer cancel()
 	req, _ := http.NewRequestWithContext(ctx, "GET",
 		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
+	if *loadFeedback {
+		req.Header.Set("accept", "application/json")
+	}
+	backend := Backends[dst]
+	resp, err := clientFor(dst).Do(req)
 	if err != nil {
+		if backend != nil {
+			backend.reportLoad(nil)
+		}
 		return false
 	}
+	// the body is drained so the connection goes back to the backend pool
+	defer resp.Body.Close()
+	load, reported := reportedLoad(resp)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if backend != nil {
+		if !reported || resp.StatusCode != http.StatusOK {
+			load = nil
+		}
+		backend.reportLoad(load)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return false
 	}
 	return true
 }
 
+// httpBalancer balances the requests of the HTTP mode over the pool. Once
+// the backends are monitored, it is replaced by the one checking their
+// health, in the TCP mode too.
+var httpBalancer atomic.Pointer[balancer.Balancer]
+
+func init() {
+	httpBalancer.Store(newHTTPBalancer(nil))
+}
+
+// newHTTPBalancer builds the balancer of the HTTP mode, which hands the
+// changes of backend health to the health hook, if any.
+func newHTTPBalancer(health func(balancer.StateChange), options ...balancer.Option) *balancer.Balancer {
+	return balancer.New(append([]balancer.Option{
+		balancer.WithPool(pool),
+		balancer.WithStrategy(frontendStrategy{}),
+		balancer.WithTransport(backendTransport{}),
+		balancer.WithHooks(balancer.Hooks{
+			Request: admitRequest,
+			Forward: prepareForward,
+			Respond: respond,
+			Error: respondError,
+			Health: health,
+		}),
+	}, options...)...)
+}
+
 func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
-
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
-			}
+	return httpBalancer.Load().Forward(dst, rw, r)
+}
+
+func admitRequest(rw http.ResponseWriter, r *http.Request) *http.Request {
+	setRequestID(r)
+
+	log.Println("remoterAddr:", r.RemoteAddr, "request:", requestID(r))
+
+	if !checkAccess(rw, r) {
+		return nil
+	}
+
+	if rejectExpired(rw, r) {
+		return nil
+	}
+
+	if injectFault(rw, r) {
+		return nil
+	}
+
+	return r
+}
+
+type forwardKey struct{}
+
+// forwardState is what the response of a forwarded request is handled with.
+type forwardState struct {
+	timeouts TimeoutConfig
+	phases *phaseTimer
+	headerRules *headerRewriter
+	headerCtx headerContext
+}
+
+func prepareForward(rw http.ResponseWriter, out *http.Request, dst string) (*http.Request, func(int)) {
+	if *traceEnabled {
+		traceVersion(rw, dst)
+
+		if panicking.Load() {
+			rw.Header().Set("lb-panic", "true")
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
+	}
+
+	start := time.Now()
+	primary := startMirror(out)
+
+	timeouts := requestTimeouts(out)
+	extendWriteDeadline(rw, timeouts)
+	ctx, phases, release := withTimeouts(out.Context(), timeouts)
+	ctx = withClientAddr(ctx, out.RemoteAddr)
+	out.URL.Scheme = scheme()
+	setDeadline(ctx, out)
+
+	state := &forwardState{
+		timeouts: timeouts,
+		phases: phases,
+		headerRules: activeHeaderRules.Load(),
+		headerCtx: newHeaderContext(out, dst),
+	}
+	rewriteHeaders(out.Header, state.headerRules.request, state.headerCtx)
+
+	backend, known := Backends[dst]
+
+	if known {
+		backend.startRequest()
+	}
+
+	return out.WithContext(context.WithValue(ctx, forwardKey{}, state)), func(status int) {
+		if known {
+			backend.finishRequest()
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
-		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+
+		release()
+
+		if primary != nil {
+			primary <- mirrorResult{status: status, latency: time.Since(start)}
 		}
-		return nil
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		return err
 	}
 }
 
-var (
-	poly = uint64(time.Now().Unix())
-	table = crc64.MakeTable(poly)
-)
+func respond(rw http.ResponseWriter, r *http.Request, resp *http.Response) error {
+	ctx := resp.Request.Context()
+	state := ctx.Value(forwardKey{}).(*forwardState)
+
+	rewriteHeaders(resp.Header, state.headerRules.response, state.headerCtx)
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-from", resp.Request.URL.Host)
+	}
+	log.Println("fwd", requestID(r), resp.StatusCode, resp.Request.URL)
+	encoding := negotiateEncoding(r, resp, rw.Header())
+	rw.WriteHeader(resp.StatusCode)
+	resp.Body = withIdleTimeout(resp.Body, state.phases, state.timeouts.Idle)
+	err := writeBody(rw, resp, encoding)
+	if err != nil {
+		if timeout, isTimeout := timedOut(ctx, err); isTimeout {
+			err = timeout
+		}
+	}
+	return err
+}
+
+func respondError(rw http.ResponseWriter, r *http.Request, dst string, err error) {
+	if errors.Is(err, balancer.ErrNoBackend) {
+		log.Printf("No backend available for %s", r.RemoteAddr)
+		writeError(rw, r, http.StatusServiceUnavailable, ReasonNoBackend, "no backend is available")
+		return
+	}
 
-func hash(str string) uint64 {
-	hasher := sha512.New()
-	hasher.Write([]byte(str))
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		log.Printf("Timed out waiting for %s: %s", dst, timeout)
+		writeError(rw, r, http.StatusGatewayTimeout, ReasonUpstreamTimeout, timeout.Error())
+		return
+	}
 
-	return crc64.Checksum(hasher.Sum(nil), table)
+	log.Printf("Failed to get response from %s: %s", dst, err)
+	writeError(rw, r, http.StatusBadGateway, ReasonUpstreamError, "the backend did not respond")
 }
 
 func GetAvailableServer(addr string) string {
-	if len(ServersPool) == 0 {
+	return availableServer(addr, "", ServersPool())
+}
+
+// availableServer hashes the client to a backend of its priority level and
+// version, forced to the given one if it is set, or picks the fastest of
+// them with the peak-ewma strategy, or keeps the client on its backend with
+// the affinity strategy. In panic mode unhealthy backends of every level are
+// picked as well.
+func availableServer(addr, version string, servers []string) string {
+	now := time.Now()
+
+	servers, panicked := balancedServers(servers)
+	if !panicked {
+		servers = activePriorities.Load().candidates(addr, servers, now)
+	}
+
+	candidates, inSubnet := subnetCandidates(addr, servers)
+
+	if split := activeVersions.Load(); !inSubnet && len(split.versions) > 0 {
+		candidates = split.candidates(addr, version, candidates)
+	}
+
+	if len(candidates) == 0 {
 		return ""
 	}
 
-	serverIndex := hash(addr) % uint64(len(ServersPool))
+	if latencyAware() {
+		return fastestServer(addr, candidates, now)
+	}
+
+	if affine() {
+		return affineServer(addr, candidates, now)
+	}
+
+	return hashedServer(addr, candidates, now)
+}
+
+// hashedServer hashes the client to one of the candidates, skipping the
+// backends that do not take the client yet.
+func hashedServer(addr string, candidates []string, now time.Time) string {
+	addrHash := balancer.Hash(addr)
+	hashed := candidates[addrHash % uint64(len(candidates))]
+
+	for len(candidates) > 0 {
+		serverIndex := addrHash % uint64(len(candidates))
+		server := candidates[serverIndex]
+
+		backend, known := Backends[server]
+
+		if !known || backend.acceptsKey(addr, now) {
+			return server
+		}
+
+		// the backend is still slowly starting and the client is not within
+		// its share yet, so it is hashed among the rest of the pool
+		candidates = slices.Delete(slices.Clone(candidates), int(serverIndex), int(serverIndex) + 1)
+	}
+
+	return hashed
+}
+
+const requestIDHeader = "X-Request-Id"
 
-	return ServersPool[serverIndex]
+// requestID returns the ID the request was given by the client or the balancer.
+func requestID(r *http.Request) string {
+	return r.Header.Get(requestIDHeader)
 }
 
-func MonitorServers(checkHealth func(string) bool) {
-	for _, server := range ServersPool {
-		server := server
-		go func() {
-			markedAsDead := false
+// validRequestID accepts the IDs safe to echo into logs, headers and error
+// pages unescaped.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
 
-			for range time.Tick(CheckServerHealthInterval) {
-				alive := checkHealth(server)
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
 
-				if !alive && markedAsDead {
-					continue
-				}
+	return true
+}
 
-				if !alive && !markedAsDead {
-					serversM.Lock()
-					serverI := slices.Index(ServersPool, server)
+// setRequestID keeps the ID given by the client if it is valid, otherwise
+// the request gets a new one.
+func setRequestID(r *http.Request) {
+	if validRequestID(requestID(r)) {
+		return
+	}
 
-					newServersPool := ServersPool[:serverI]
-					newServersPool = append(newServersPool, ServersPool[serverI + 1:]...)
+	id := make([]byte, 12)
+	_, _ = rand.Read(id)
 
-					ServersPool = newServersPool
+	r.Header.Set(requestIDHeader, hex.EncodeToString(id))
+}
 
-					serversM.Unlock()
+// MonitorServers checks the backends until ctx is done or the returned
+// balancer is stopped, moving them in and out of the pool. The balancer
+// replaces the one of the HTTP mode.
+func MonitorServers(ctx context.Context, checkHealth balancer.HealthChecker) *balancer.Balancer {
+	backends := Backends
 
-					log.Printf("%v died\n", server)
-					markedAsDead = true
-				}
+	check := func(address string) bool {
+		start := time.Now()
+		alive := checkHealth(address)
+		backends[address].metrics.recordCheck(start, time.Since(start), alive)
 
-				if markedAsDead && alive {
-					serversM.Lock()
+		return alive
+	}
 
-					ServersPool = append(ServersPool, server)
+	monitored := newHTTPBalancer(func(change balancer.StateChange) {
+		backend := backends[change.Target]
 
-					serversM.Unlock()
+		if !change.Healthy && backend.Transition(StateUnhealthy, StateHealthy) {
+			backend.metrics.lastDied.Store(change.Time.UnixNano())
+			log.Printf("%v died\n", backend.Address)
+		}
 
-					log.Printf("%v resurretcted\n", server)
-					markedAsDead = false
-				}
-			}
-		}()
+		if change.Healthy && backend.Transition(StateHealthy, StateUnhealthy) {
+			backend.metrics.lastResurrected.Store(change.Time.UnixNano())
+			log.Printf("%v resurretcted\n", backend.Address)
+			go backend.Prewarm(*prewarmConns)
+		}
+	}, balancer.WithHealthChecker(check, CheckServerHealthInterval))
+
+	// the pool only holds the healthy backends, while the unhealthy and
+	// draining ones are checked as well, and the ones in maintenance once
+	// they are enabled
+	for address, backend := range backends {
+		if backend.State() != StateMaintenance {
+			monitored.Monitor().Add(address)
+		}
 	}
+
+	httpBalancer.Store(monitored)
+	monitored.Start(ctx)
+
+	return monitored
 }
 
 func main() {
@@ -161,20 +367,124 @@ func main() {
 
 	log.Println("Balancer started")
 
-	MonitorServers(health)
+	if *mode != "http" && *mode != "tcp" {
+		log.Fatalf("Unknown balancing mode %#v", *mode)
+	}
+
+	if *strategy != "hash" && *strategy != "peak-ewma" && *strategy != "affinity" {
+		log.Fatalf("Unknown balancing strategy %#v", *strategy)
+	}
+
+	if !validCompressLevel(*compressLevel) {
+		log.Fatalf("Invalid -compress-level %d", *compressLevel)
+	}
+
+	latencyStrategy.Decay = *ewmaDecay
+	latencyStrategy.Affinity = *ewmaAffinity
+
+	if *mode == "http" {
+		for _, backend := range Backends {
+			go backend.Prewarm(*prewarmConns)
+		}
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		log.Println("remoterAddr:", r.RemoteAddr)
+	outbox, err := newWebhookOutbox(*webhookOutboxPath, *webhookRetries, *webhookTimeout)
+	if err != nil {
+		log.Fatalf("Failed to load webhook outbox: %s", err)
+	}
+	events.Resume(outbox.LastEventID())
+
+	onConfig(func(config *Config) {
+		outbox.SetWebhooks(config.Webhooks)
+
+		// the config is validated on load, so the rules always compile
+		_ = setFaults(config.Faults)
+		setMirror(config.Mirror)
+		setVersions(config.Versions)
+		setPriorities(config.Priorities)
+		_ = setHeaderRules(config.Headers)
+		_ = setRoutes(config.Access, config.Routes)
+		_ = setSubnetPools(config.SubnetPools)
+		_ = setErrorPages(config.ErrorPages)
+	})
+	events.AddSink(outbox.Enqueue)
+	applyConfig(config)
+
+	stopOutbox := outbox.Start()
+
+	signal.OnReloadSignal(func() {
+		_ = reloadConfig()
+	})
+
+	checkHealth := health
+	if *healthCheck == "tcp" || (*healthCheck == "" && *mode == "tcp") {
+		checkHealth = tcpHealth
+	}
+
+	log.Printf("Starting admin server on %s port %d...", *adminAddr, *adminPort)
+	admin := startAdmin()
 
-		server := GetAvailableServer(r.RemoteAddr)
+	sweepBackends(checkHealth)
+	lb := MonitorServers(context.Background(), checkHealth)
+	waitHealthy(*minHealthy, *minHealthyTimeout)
+
+	var wrappers []httptools.ListenerWrapper
+
+	if *proxyProtocol {
+		trusted, err := parseCIDRs(*proxyTrustedCIDRs)
+		if err != nil {
+			log.Fatalf("Invalid -proxy-trusted-cidrs: %s", err)
+		}
 
-		if server != "" {
-			forward(server, rw, r)
+		if len(trusted) == 0 {
+			log.Fatalf("-proxy-protocol requires -proxy-trusted-cidrs, otherwise any client can spoof its address")
 		}
-	}))
 
-	log.Println("Starting load balancer...")
+		wrappers = append(wrappers, proxyProtocolListener(trusted))
+	}
+
+	stopSnapshots := func() {}
+	if *affinitySnapshot != "" {
+		stopSnapshots = startAffinitySnapshots(*affinitySnapshot, *affinitySnapshotInterval)
+	}
+
+	var frontend httptools.Server = httptools.CreateServer(*port, lb, wrappers...)
+
+	if *mode == "tcp" {
+		frontend = createTCPServer(*port, *tcpListeners, wrappers...)
+	}
+
+	log.Printf("Starting load balancer in %s mode...", *mode)
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("PROXY protocol support enabled: %t", *proxyProtocol)
+	// Start returns once the listener is open
 	frontend.Start()
+	serving.Store(true)
+
 	signal.WaitForTerminationSignal()
+	serving.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if err := frontend.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain connections: %s", err)
+	}
+
+	// event streams never finish on their own
+	events.Close()
+
+	if err := admin.Shutdown(ctx); err != nil {
+		log.Printf("Failed to stop admin server: %s", err)
+	}
+
+	lb.Stop()
+	stopOutbox()
+
+	stopSnapshots()
 }
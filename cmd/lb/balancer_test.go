@@ -2,11 +2,14 @@ package main
 
 import . "github.com/magicvegetable/architecture-lab-4/integration"
 import (
+	"context"
 	"testing"
 	"fmt"
 	"math/rand"
 	"time"
 	"slices"
+	"sync"
+	"github.com/magicvegetable/architecture-lab-4/balancer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,36 +18,8 @@ const (
 	maxPort = uint64(65535)
 	GetAvailableServerTestsAmount = 100
 	GetAvailableServerTestsChecksAmount = 100
-
-	maxRandStrSize = uint64(100)
-	HashTestsAmount = 100
-	HashTestsChecksAmount = 100
 )
 
-func randStr() string {
-	size := rand.Uint64() % (maxRandStrSize + 1)
-	str := ""
-
-	for i := uint64(0); i < size; i++ {
-		str += fmt.Sprintf("%c", rand.Int())
-	}
-
-	return str
-}
-
-func TestHash(t *testing.T) {
-	for i := 0; i < HashTestsAmount; i++ {
-		str := randStr()
-
-		h1 := hash(str)
-		for i := 0; i < HashTestsChecksAmount; i++ {
-			h2 := hash(str)
-
-			assert.Equal(t, h1, h2, "same hash for the same string")
-		}
-	}
-}
-
 func TestGetAvailableServer(t *testing.T) {
 	for i := 0; i < GetAvailableServerTestsAmount; i++ {
 		ipNet := RandIPNet()
@@ -63,9 +38,15 @@ func TestGetAvailableServer(t *testing.T) {
 	}
 }
 
-var aliveServers = append([]string{}, ServersPool...)
+var (
+	aliveServers = append([]string{}, DefaultServers...)
+	aliveM = sync.Mutex{}
+)
 
 func killServer(server string) {
+	aliveM.Lock()
+	defer aliveM.Unlock()
+
 	serverI := slices.Index(aliveServers, server)
 
 	if serverI == -1 {
@@ -79,6 +60,9 @@ func killServer(server string) {
 }
 
 func resurrectServer(server string) {
+	aliveM.Lock()
+	defer aliveM.Unlock()
+
 	if slices.Contains(aliveServers, server) {
 		return
 	}
@@ -86,18 +70,48 @@ func resurrectServer(server string) {
 	aliveServers = append(aliveServers, server)
 }
 
+// withAlive makes only the given servers pass HealthMock checks for the
+// duration of a test.
+func withAlive(t *testing.T, servers ...string) {
+	aliveM.Lock()
+	saved := aliveServers
+	aliveServers = append([]string{}, servers...)
+	aliveM.Unlock()
+
+	t.Cleanup(func() {
+		aliveM.Lock()
+		aliveServers = saved
+		aliveM.Unlock()
+	})
+}
+
 func HealthMock(dst string) bool {
+	aliveM.Lock()
+	defer aliveM.Unlock()
+
 	return slices.Contains(aliveServers, dst)
 }
 
+// monitorServers checks the backends until the test ends, then restores the
+// balancer of the HTTP mode.
+func monitorServers(t *testing.T, check balancer.HealthChecker) {
+	saved := httpBalancer.Load()
+	monitored := MonitorServers(context.Background(), check)
+
+	t.Cleanup(func() {
+		monitored.Stop()
+		httpBalancer.Store(saved)
+	})
+}
+
 func TestBalancer(t *testing.T) {
-	allServers := append([]string{}, ServersPool...)
+	allServers := append([]string{}, ServersPool()...)
 
 	TestServersPoolStateInterval := 10 * time.Millisecond
 	CheckServerHealthInterval = 1 * time.Millisecond
 
-	MonitorServers(HealthMock)
-	
+	monitorServers(t, HealthMock)
+
 	for _, server := range allServers {
 		t.Run("kill " + server, func(t *testing.T) {
 			killServer(server)
@@ -105,7 +119,7 @@ func TestBalancer(t *testing.T) {
 
 			assert.NotContains(
 				t,
-				ServersPool,
+				ServersPool(),
 				server,
 				"No dead server in the ServersPool",
 			)
@@ -119,7 +133,7 @@ func TestBalancer(t *testing.T) {
 
 			assert.Contains(
 				t,
-				ServersPool,
+				ServersPool(),
 				server,
 				"Alive server in the ServersPool",
 			)
@@ -127,3 +141,99 @@ func TestBalancer(t *testing.T) {
 	}
 }
 
+
+const (
+	PoolStressReaders = 8
+	PoolStressFlips = 2000
+)
+
+// TestPoolStress flips backends in and out of the pool while requests pick
+// servers from it. Run with -race to check the pool is read without races.
+func TestPoolStress(t *testing.T) {
+	servers := []string{"stress1:8080", "stress2:8080", "stress3:8080", "stress4:8080"}
+	withPool(t, servers...)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	for i := 0; i < PoolStressReaders; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				server := GetAvailableServer(fmt.Sprintf("10.0.%d.%d:4000", i, j % 256))
+				if server != "" && !slices.Contains(servers, server) {
+					t.Errorf("unknown server %#v picked", server)
+				}
+
+				snapshot := ServersPool()
+				sorted := slices.Clone(snapshot)
+				slices.Sort(sorted)
+				if len(slices.Compact(sorted)) != len(snapshot) {
+					t.Errorf("torn pool %v", snapshot)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < PoolStressFlips; i++ {
+		backend := Backends[servers[i % len(servers)]]
+
+		if !backend.Transition(StateUnhealthy, StateHealthy) {
+			backend.Transition(StateHealthy, StateUnhealthy)
+		}
+	}
+
+	close(stop)
+	for i := 0; i < PoolStressReaders; i++ {
+		<-done
+	}
+}
+
+// BenchmarkGetAvailableServerContention picks servers from all the cores
+// while a backend keeps leaving and rejoining the pool.
+func BenchmarkGetAvailableServerContention(b *testing.B) {
+	servers := []string{"bench1:8080", "bench2:8080", "bench3:8080", "bench4:8080"}
+	withPool(b, servers...)
+
+	withSlowStart(b, 0)
+
+	stop := make(chan struct{})
+	flipped := make(chan struct{})
+
+	go func() {
+		defer close(flipped)
+		backend := Backends[servers[0]]
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			backend.Transition(StateUnhealthy, StateHealthy)
+			backend.Transition(StateHealthy, StateUnhealthy)
+		}
+	}()
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			GetAvailableServer(fmt.Sprintf("10.1.%d.%d:4000", i / 256 % 256, i % 256))
+			i++
+		}
+	})
+
+	b.StopTimer()
+	close(stop)
+	<-flipped
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"flag"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+)
+
+var (
+	compressEnabled = flag.Bool("compress", true, "whether to compress eligible responses with gzip or deflate")
+	compressMinSize = flag.Int("compress-min-size", 1024, "minimal response size in bytes to compress")
+	compressTypes = flag.String(
+		"compress-types",
+		"text/*,application/json,application/javascript,application/xml,image/svg+xml",
+		"comma separated list of content types to compress",
+	)
+	compressLevel = flag.Int("compress-level", gzip.DefaultCompression, "compression level from 1 (best speed) to 9 (best compression), 0 for none, -1 for default, -2 for Huffman only")
+)
+
+// supportedEncodings are listed in the order of preference.
+var supportedEncodings = []string{"gzip", "deflate"}
+
+func acceptedEncoding(acceptEncoding string) string {
+	best := ""
+	bestQ := 0.0
+	wildcardQ := -1.0
+	explicit := map[string]bool{}
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q := 1.0
+		if name, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		if coding == "*" {
+			wildcardQ = q
+			continue
+		}
+
+		explicit[coding] = true
+
+		for _, encoding := range supportedEncodings {
+			if coding == encoding && q > bestQ {
+				best, bestQ = encoding, q
+			}
+		}
+	}
+
+	if best == "" && wildcardQ > 0 {
+		for _, encoding := range supportedEncodings {
+			if !explicit[encoding] {
+				return encoding
+			}
+		}
+	}
+
+	return best
+}
+
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range strings.Split(*compressTypes, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+
+		if prefix, found := strings.CutSuffix(allowed, "/*"); found {
+			if strings.HasPrefix(mediaType, prefix + "/") {
+				return true
+			}
+			continue
+		}
+
+		if mediaType == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressible reports whether the response may be compressed for some client,
+// regardless of what the current client accepts.
+func compressible(r *http.Request, resp *http.Response) bool {
+	if !*compressEnabled || r.Method == http.MethodHead {
+		return false
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	if resp.ContentLength >= 0 && resp.ContentLength < int64(*compressMinSize) {
+		return false
+	}
+
+	return compressibleType(resp.Header.Get("Content-Type"))
+}
+
+func addVary(header http.Header, value string) {
+	for _, vary := range header.Values("Vary") {
+		for _, field := range strings.Split(vary, ",") {
+			field = strings.TrimSpace(field)
+
+			if field == "*" || strings.EqualFold(field, value) {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", value)
+}
+
+// negotiateEncoding prepares the response headers already copied to the header
+// and returns the encoding to apply to the body, if any.
+func negotiateEncoding(r *http.Request, resp *http.Response, header http.Header) string {
+	if !compressible(r, resp) {
+		return ""
+	}
+
+	addVary(header, "Accept-Encoding")
+
+	encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return ""
+	}
+
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/" + etag)
+	}
+
+	return encoding
+}
+
+// validCompressLevel reports whether both gzip and deflate accept the level.
+// The encoder is created after the Content-Encoding header is sent, so an
+// invalid level has to be caught at startup.
+func validCompressLevel(level int) bool {
+	return level == gzip.HuffmanOnly || (level >= gzip.DefaultCompression && level <= gzip.BestCompression)
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(w io.Writer, encoding string) (encoder, error) {
+	if encoding == "deflate" {
+		return zlib.NewWriterLevel(w, *compressLevel)
+	}
+
+	return gzip.NewWriterLevel(w, *compressLevel)
+}
+
+// writeBody copies the backend response body to the client, compressing it
+// with the given encoding. Responses of unknown length are flushed after
+// every read so streaming keeps working through the balancer.
+func writeBody(rw http.ResponseWriter, resp *http.Response, encoding string) error {
+	flush := func() error { return nil }
+	if flusher, ok := rw.(http.Flusher); ok {
+		flush = func() error {
+			flusher.Flush()
+			return nil
+		}
+	}
+
+	if encoding == "" {
+		return balancer.CopyBody(rw, resp, flush)
+	}
+
+	enc, err := newEncoder(rw, encoding)
+	if err != nil {
+		return err
+	}
+
+	err = balancer.CopyBody(enc, resp, func() error {
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+		return flush()
+	})
+
+	if closeErr := enc.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                         "",
+		"gzip":                     "gzip",
+		"deflate":                  "deflate",
+		"gzip, deflate, br":        "gzip",
+		"deflate;q=1, gzip;q=0.5":  "deflate",
+		"gzip;q=0":                 "",
+		"gzip;q=0, *":              "deflate",
+		"*":                        "gzip",
+		"br, identity":             "",
+	}
+
+	for header, expected := range cases {
+		assert.Equal(t, expected, acceptedEncoding(header), "encoding for %#v", header)
+	}
+}
+
+func TestCompressibleType(t *testing.T) {
+	assert.True(t, compressibleType("text/html; charset=utf-8"))
+	assert.True(t, compressibleType("application/json"))
+	assert.False(t, compressibleType("image/png"))
+	assert.False(t, compressibleType(""))
+}
+
+func TestValidCompressLevel(t *testing.T) {
+	withFlag(t, compressLevel, *compressLevel)
+
+	for _, level := range []int{gzip.HuffmanOnly, gzip.DefaultCompression, gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression} {
+		assert.True(t, validCompressLevel(level), "level %d", level)
+
+		*compressLevel = level
+		for _, encoding := range supportedEncodings {
+			_, err := newEncoder(io.Discard, encoding)
+			assert.Nil(t, err, "%s level %d", encoding, level)
+		}
+	}
+
+	for _, level := range []int{-3, 10} {
+		assert.False(t, validCompressLevel(level), "level %d", level)
+	}
+}
+
+func compressionBackend(contentType, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", contentType)
+		rw.Header().Set("etag", `"v1"`)
+		_, _ = rw.Write([]byte(body))
+	}))
+}
+
+func forwardTo(backend *httptest.Server, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	rec := httptest.NewRecorder()
+	forward(backend.Listener.Addr().String(), rec, req)
+
+	return rec
+}
+
+func TestForwardCompression(t *testing.T) {
+	body := strings.Repeat("some-data ", *compressMinSize)
+	backend := compressionBackend("application/json", body)
+	defer backend.Close()
+
+	t.Run("gzip", func(t *testing.T) {
+		rec := forwardTo(backend, "gzip, deflate")
+
+		assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+		assert.Equal(t, `W/"v1"`, rec.Header().Get("ETag"))
+		assert.Empty(t, rec.Header().Get("Content-Length"))
+
+		reader, err := gzip.NewReader(rec.Body)
+		assert.Nil(t, err)
+
+		decoded, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, body, string(decoded))
+	})
+
+	t.Run("deflate", func(t *testing.T) {
+		rec := forwardTo(backend, "deflate")
+
+		assert.Equal(t, "deflate", rec.Header().Get("Content-Encoding"))
+
+		reader, err := zlib.NewReader(rec.Body)
+		assert.Nil(t, err)
+
+		decoded, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, body, string(decoded))
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		rec := forwardTo(backend, "")
+
+		assert.Empty(t, rec.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), "cacheable variant is still marked")
+		assert.Equal(t, body, rec.Body.String())
+	})
+}
+
+func TestForwardCompressionSkipped(t *testing.T) {
+	small := compressionBackend("application/json", `["1","2"]`)
+	defer small.Close()
+
+	rec := forwardTo(small, "gzip")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "small body")
+	assert.Empty(t, rec.Header().Get("Vary"))
+
+	binary := compressionBackend("image/png", strings.Repeat("x", 2 * *compressMinSize))
+	defer binary.Close()
+
+	rec = forwardTo(binary, "gzip")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "not allowed content type")
+}
+
+func TestForwardCompressionStreaming(t *testing.T) {
+	chunks := []string{"data: first\n\n", "data: second\n\n"}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "text/plain")
+		for _, chunk := range chunks {
+			_, _ = rw.Write([]byte(chunk))
+			rw.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	rec := forwardTo(backend, "gzip")
+
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.True(t, rec.Flushed, "streamed response is flushed")
+
+	reader, err := gzip.NewReader(rec.Body)
+	assert.Nil(t, err)
+
+	decoded, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Join(chunks, ""), string(decoded))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var configPath = flag.String("config", "", "path to a JSON configuration file, reloaded on SIGHUP")
+
+// Config holds the balancer settings that can change without a restart.
+type Config struct {
+	Webhooks []WebhookConfig `json:"webhooks"`
+	Faults []FaultRule `json:"faults"`
+	Mirror MirrorConfig `json:"mirror"`
+	Versions []VersionConfig `json:"versions"`
+	Priorities PriorityConfig `json:"priorities"`
+	Headers HeaderRules `json:"headers"`
+	Access AccessConfig `json:"access"`
+	Routes []RouteConfig `json:"routes"`
+	SubnetPools []SubnetPoolConfig `json:"subnet_pools"`
+	Timeouts TimeoutConfig `json:"timeouts"`
+	ErrorPages ErrorPagesConfig `json:"error_pages"`
+}
+
+// Duration is a time.Duration written as "1.5s" or "300ms" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+var (
+	currentConfig atomic.Pointer[Config]
+	configM sync.Mutex
+	configAppliers []func(*Config)
+)
+
+func init() {
+	currentConfig.Store(&Config{})
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+func (c *Config) Validate() error {
+	for _, webhook := range c.Webhooks {
+		if webhook.URL == "" {
+			return fmt.Errorf("webhook without url")
+		}
+	}
+
+	if _, err := compileFaults(c.Faults); err != nil {
+		return err
+	}
+
+	if err := c.Mirror.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateVersions(c.Versions); err != nil {
+		return err
+	}
+
+	if err := c.Priorities.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Headers.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := compileRoutes(c.Access, c.Routes); err != nil {
+		return err
+	}
+
+	if _, err := compileSubnetPools(c.SubnetPools); err != nil {
+		return err
+	}
+
+	if err := c.Timeouts.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := compileErrorPages(c.ErrorPages); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// onConfig registers a function applying the configuration whenever it is
+// loaded.
+func onConfig(apply func(*Config)) {
+	configM.Lock()
+	defer configM.Unlock()
+
+	configAppliers = append(configAppliers, apply)
+}
+
+func applyConfig(config *Config) {
+	configM.Lock()
+	defer configM.Unlock()
+
+	currentConfig.Store(config)
+
+	for _, apply := range configAppliers {
+		apply(config)
+	}
+}
+
+// reloadConfig reads the configuration file again. On failure the current
+// configuration stays in effect.
+func reloadConfig() error {
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		log.Printf("Failed to reload config: %s", err)
+		events.Publish(Event{Type: EventConfigReloadFailed, Detail: err.Error()})
+		return err
+	}
+
+	applyConfig(config)
+
+	log.Printf("Config reloaded from %#v", *configPath)
+	events.Publish(Event{Type: EventConfigReloaded, Detail: *configPath})
+
+	return nil
+}
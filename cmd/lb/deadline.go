@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/httptools"
+)
+
+var propagateDeadline = flag.Bool("propagate-deadline", true, "send backends the time left before the request times out in the X-Request-Deadline header")
+
+// clientDeadline is the time the client is still willing to wait, if it
+// sent httptools.DeadlineHeader.
+func clientDeadline(r *http.Request) (time.Duration, bool) {
+	return httptools.ParseDeadline(r.Header.Get(httptools.DeadlineHeader))
+}
+
+// rejectExpired answers the requests whose client deadline already passed
+// instead of forwarding them. It reports whether the request was answered.
+func rejectExpired(rw http.ResponseWriter, r *http.Request) bool {
+	if remaining, ok := clientDeadline(r); !ok || remaining > 0 {
+		return false
+	}
+
+	log.Printf("Request %s arrived past its deadline", requestID(r))
+	writeError(rw, r, http.StatusGatewayTimeout, ReasonDeadlineExceeded, "the request deadline passed before it was forwarded")
+
+	return true
+}
+
+// setDeadline tells the backend how long the balancer waits for the request
+// bounded by ctx.
+func setDeadline(ctx context.Context, out *http.Request) {
+	if !*propagateDeadline {
+		return
+	}
+
+	deadline, bounded := ctx.Deadline()
+	if !bounded {
+		out.Header.Del(httptools.DeadlineHeader)
+		return
+	}
+
+	out.Header.Set(httptools.DeadlineHeader, httptools.FormatDeadline(time.Until(deadline)))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/httptools"
+	"github.com/stretchr/testify/assert"
+)
+
+// deadlineBackend records the deadline header of the last request.
+func deadlineBackend(received *atomic.Value) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received.Store(r.Header.Get(httptools.DeadlineHeader))
+		_, _ = rw.Write([]byte("ok"))
+	}))
+}
+
+func TestForwardPropagatesDeadline(t *testing.T) {
+	var received atomic.Value
+	backend := deadlineBackend(&received)
+	defer backend.Close()
+
+	rw := httptest.NewRecorder()
+	assert.Nil(t, forward(backend.Listener.Addr().String(), rw, httptest.NewRequest("GET", "/api/v1/some-data", nil)))
+
+	ms, err := strconv.Atoi(received.Load().(string))
+	assert.Nil(t, err)
+	assert.InDelta(t, *timeoutSec * 1000, ms, 100, "the backend gets the total timeout")
+
+	req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	req.Header.Set(httptools.DeadlineHeader, "400")
+
+	rw = httptest.NewRecorder()
+	assert.Nil(t, forward(backend.Listener.Addr().String(), rw, req))
+
+	ms, err = strconv.Atoi(received.Load().(string))
+	assert.Nil(t, err)
+	assert.InDelta(t, 400, ms, 100, "the client deadline shortens the timeout")
+
+	withFlag(t, propagateDeadline, false)
+
+	rw = httptest.NewRecorder()
+	assert.Nil(t, forward(backend.Listener.Addr().String(), rw, httptest.NewRequest("GET", "/api/v1/some-data", nil)))
+	assert.Equal(t, "", received.Load())
+}
+
+func TestClientDeadlineTimesOut(t *testing.T) {
+	backend := slowBackend(time.Second)
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	req.Header.Set(httptools.DeadlineHeader, "100")
+
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	err := forward(backend.Listener.Addr().String(), rw, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.Less(t, time.Since(start), 500 * time.Millisecond)
+	assert.ErrorContains(t, err, "total timeout")
+}
+
+func TestExpiredDeadlineIsNotForwarded(t *testing.T) {
+	var hits atomic.Int64
+	backend := delayedBackend(0, &hits)
+	defer backend.Close()
+
+	withPool(t, backend.Listener.Addr().String())
+
+	req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	req.Header.Set(httptools.DeadlineHeader, "0")
+
+	rw := httptest.NewRecorder()
+	httpBalancer.Load().ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.Contains(t, rw.Body.String(), ReasonDeadlineExceeded)
+	assert.Equal(t, int64(0), hits.Load())
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventDied = "died"
+	EventResurrected = "resurrected"
+	EventDraining = "draining"
+	EventDrained = "drained"
+	EventMaintenance = "maintenance"
+	EventEnabled = "enabled"
+	EventConfigReloaded = "config-reloaded"
+	EventConfigReloadFailed = "config-reload-failed"
+)
+
+type Event struct {
+	ID uint64 `json:"id"`
+	Type string `json:"type"`
+	Time time.Time `json:"time"`
+	Backend string `json:"backend,omitempty"`
+	From string `json:"from,omitempty"`
+	To string `json:"to,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// transitionEvent names the pool membership change of a backend.
+func transitionEvent(from, to BackendState) string {
+	switch {
+	case to == StateUnhealthy && from == StateHealthy:
+		return EventDied
+	case to == StateHealthy && from == StateUnhealthy:
+		return EventResurrected
+	case to == StateDraining:
+		return EventDraining
+	case to == StateMaintenance:
+		return EventMaintenance
+	}
+
+	return EventEnabled
+}
+
+const (
+	eventHistorySize = 100
+	subscriberBufferSize = 64
+)
+
+// eventBus fans events out to the subscribers and keeps the recent ones so
+// reconnecting clients can catch up.
+type eventBus struct {
+	m sync.Mutex
+	lastID uint64
+	history []Event
+	subscribers map[chan Event]struct{}
+	sinks []func(Event)
+	closed bool
+}
+
+var events = newEventBus()
+
+// newEventBus numbers the events from the start time, so their IDs keep
+// growing over restarts.
+func newEventBus() *eventBus {
+	return &eventBus{
+		lastID: uint64(time.Now().UnixMicro()),
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// Resume numbers the next events after the ID, if it is higher than the
+// last one.
+func (b *eventBus) Resume(lastID uint64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.lastID = max(b.lastID, lastID)
+}
+
+// Publish numbers the event and delivers it to the subscribers, and then to
+// the sinks outside of the bus lock, as they may be slow.
+func (b *eventBus) Publish(event Event) Event {
+	b.m.Lock()
+
+	b.lastID += 1
+	event.ID = b.lastID
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history) - eventHistorySize:]
+	}
+
+	for subscriber := range b.subscribers {
+		// a slow subscriber loses events instead of blocking the balancer
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+
+	sinks := b.sinks
+	b.m.Unlock()
+
+	for _, sink := range sinks {
+		sink(event)
+	}
+
+	return event
+}
+
+// AddSink registers a callback receiving every published event.
+func (b *eventBus) AddSink(sink func(Event)) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.sinks = append(b.sinks, sink)
+}
+
+// Subscribe returns the events published after afterID followed by the
+// live ones. The returned function cancels the subscription.
+func (b *eventBus) Subscribe(afterID uint64) (<-chan Event, []Event, func()) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	var missed []Event
+	for _, event := range b.history {
+		if event.ID > afterID {
+			missed = append(missed, event)
+		}
+	}
+
+	subscriber := make(chan Event, subscriberBufferSize)
+
+	if b.closed {
+		close(subscriber)
+		return subscriber, missed, func() {}
+	}
+
+	b.subscribers[subscriber] = struct{}{}
+
+	return subscriber, missed, func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+
+		if _, subscribed := b.subscribers[subscriber]; subscribed {
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Close ends every subscription, so the event streams finish on shutdown.
+func (b *eventBus) Close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.closed = true
+
+	for subscriber := range b.subscribers {
+		delete(b.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+const sseKeepAliveInterval = 15 * time.Second
+
+func writeSSE(rw http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// serveEvents streams the events as Server-Sent Events.
+func serveEvents(rw http.ResponseWriter, r *http.Request) {
+	controller := http.NewResponseController(rw)
+
+	// the stream outlives the write timeout of the admin server
+	_ = controller.SetWriteDeadline(time.Time{})
+
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	live, missed, cancel := events.Subscribe(lastID)
+	defer cancel()
+
+	rw.Header().Set("content-type", "text/event-stream")
+	rw.Header().Set("cache-control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+
+	for _, event := range missed {
+		if writeSSE(rw, event) != nil {
+			return
+		}
+	}
+
+	if controller.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-live:
+			if !ok || writeSSE(rw, event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+
+		if controller.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBusReplay(t *testing.T) {
+	bus := newEventBus()
+
+	first := bus.Publish(Event{Type: EventDied, Backend: "a:8080"})
+	bus.Publish(Event{Type: EventResurrected, Backend: "a:8080"})
+
+	live, missed, cancel := bus.Subscribe(first.ID)
+	defer cancel()
+
+	assert.Len(t, missed, 1, "only events after the given one are replayed")
+	assert.Equal(t, EventResurrected, missed[0].Type)
+
+	bus.Publish(Event{Type: EventDraining, Backend: "a:8080"})
+	assert.Equal(t, EventDraining, (<-live).Type)
+
+	bus.Close()
+	_, ok := <-live
+	assert.False(t, ok, "subscriptions end on close")
+}
+
+func TestEventBusResumes(t *testing.T) {
+	persisted := newEventBus().Publish(Event{Type: EventDied, Backend: "a:8080"})
+
+	restarted := newEventBus()
+	restarted.Resume(persisted.ID + 100)
+	assert.Equal(t, persisted.ID + 101, restarted.Publish(Event{Type: EventDied}).ID, "IDs of a restarted balancer do not repeat")
+
+	restarted.Resume(1)
+	assert.Equal(t, persisted.ID + 102, restarted.Publish(Event{Type: EventDied}).ID)
+}
+
+func TestEventBusSinksRunUnlocked(t *testing.T) {
+	bus := newEventBus()
+	bus.AddSink(func(Event) {
+		_, _, cancel := bus.Subscribe(0)
+		cancel()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		bus.Publish(Event{Type: EventDied})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sink is called with the bus locked")
+	}
+}
+
+func TestTransitionEvents(t *testing.T) {
+	withPool(t, "events:8080")
+
+	live, _, cancel := events.Subscribe(^uint64(0))
+	defer cancel()
+
+	backend := Backends["events:8080"]
+	backend.Transition(StateUnhealthy, StateHealthy)
+	backend.Transition(StateHealthy, StateUnhealthy)
+	backend.Transition(StateDraining, StateHealthy)
+
+	expected := []string{EventDied, EventResurrected, EventDraining, EventDrained}
+
+	for _, eventType := range expected {
+		for event := range live {
+			if event.Backend != "events:8080" {
+				continue
+			}
+
+			assert.Equal(t, eventType, event.Type)
+			break
+		}
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	withPool(t, "sse:8080")
+
+	server := httptest.NewServer(adminHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "text/event-stream", resp.Header.Get("content-type"))
+
+	Backends["sse:8080"].Transition(StateMaintenance, StateHealthy)
+
+	reader := bufio.NewReader(resp.Body)
+
+	for {
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+
+		data, found := strings.CutPrefix(line, "data: ")
+		if !found {
+			continue
+		}
+
+		var event Event
+		assert.Nil(t, json.Unmarshal([]byte(data), &event))
+
+		if event.Backend == "sse:8080" {
+			assert.Equal(t, EventMaintenance, event.Type)
+			assert.Equal(t, "healthy", event.From)
+			break
+		}
+	}
+}
+
+func TestWebhookOutboxRetries(t *testing.T) {
+	withFlag(t, &webhookBackoffBase, time.Millisecond)
+
+	attempts := atomic.Int64{}
+	delivered := make(chan Event, 1)
+
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		var event Event
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		delivered <- event
+	}))
+	defer hook.Close()
+
+	outbox, err := newWebhookOutbox("", 5, time.Second)
+	assert.Nil(t, err)
+	outbox.SetWebhooks([]WebhookConfig{{URL: hook.URL}})
+
+	// the outbox has to stop before the backoff is restored
+	defer outbox.Start()()
+
+	outbox.Enqueue(Event{ID: 7, Type: EventDied, Backend: "a:8080", Time: time.Now()})
+
+	select {
+	case event := <-delivered:
+		assert.Equal(t, uint64(7), event.ID)
+		assert.Equal(t, int64(3), attempts.Load())
+	case <-time.After(5 * time.Second):
+		t.Fatal("event is not delivered")
+	}
+}
+
+func TestWebhookOutboxFilter(t *testing.T) {
+	outbox, err := newWebhookOutbox("", 5, time.Second)
+	assert.Nil(t, err)
+	outbox.SetWebhooks([]WebhookConfig{{URL: "http://alerts", Events: []string{EventDied}}})
+
+	outbox.Enqueue(Event{Type: EventResurrected})
+	outbox.Enqueue(Event{Type: EventDied})
+
+	assert.Len(t, outbox.entries, 1)
+	assert.Equal(t, EventDied, outbox.entries[0].Event.Type)
+}
+
+func TestWebhookOutboxPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+
+	outbox, err := newWebhookOutbox(path, 5, time.Second)
+	assert.Nil(t, err)
+	outbox.SetWebhooks([]WebhookConfig{{URL: "http://127.0.0.1:1/unreachable"}})
+
+	outbox.Enqueue(Event{ID: 3, Type: EventDied, Backend: "a:8080", Time: time.Now()})
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "enqueueing does not wait for the disk")
+
+	stop := outbox.Start()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	stop()
+
+	restored, err := newWebhookOutbox(path, 5, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, restored.entries, 1, "undelivered event survives a restart")
+	assert.Equal(t, uint64(3), restored.entries[0].Event.ID)
+	assert.Equal(t, uint64(3), restored.LastEventID())
+}
+
+func TestWebhookOutboxShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+
+	delivering := make(chan struct{})
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(delivering)
+		<-release
+	}))
+	defer hook.Close()
+	defer close(release)
+
+	outbox, err := newWebhookOutbox(path, 5, time.Minute)
+	assert.Nil(t, err)
+	outbox.SetWebhooks([]WebhookConfig{{URL: hook.URL}})
+
+	stop := outbox.Start()
+	outbox.Enqueue(Event{ID: 5, Type: EventDied, Backend: "a:8080", Time: time.Now()})
+	<-delivering
+	stop()
+
+	restored, err := newWebhookOutbox(path, 5, time.Minute)
+	assert.Nil(t, err)
+	assert.Len(t, restored.entries, 1, "event being delivered on shutdown is persisted")
+	assert.Equal(t, uint64(5), restored.entries[0].Event.ID)
+	assert.Equal(t, 0, restored.entries[0].Attempts, "cancelled delivery is not an attempt")
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	saved := *configPath
+	*configPath = path
+	t.Cleanup(func() {
+		*configPath = saved
+		applyConfig(&Config{})
+	})
+
+	live, _, cancel := events.Subscribe(^uint64(0))
+	defer cancel()
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"webhooks": [{"url": "http://alerts"}]}`), 0o644))
+	assert.Nil(t, reloadConfig())
+	assert.Equal(t, "http://alerts", currentConfig.Load().Webhooks[0].URL)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"webhooks": [{}]}`), 0o644))
+	assert.NotNil(t, reloadConfig())
+	assert.Equal(t, "http://alerts", currentConfig.Load().Webhooks[0].URL, "invalid config is not applied")
+
+	types := []string{}
+	for event := range live {
+		if strings.HasPrefix(event.Type, "config-") {
+			types = append(types, event.Type)
+		}
+
+		if len(types) == 2 {
+			break
+		}
+	}
+
+	assert.Equal(t, []string{EventConfigReloaded, EventConfigReloadFailed}, types)
+}
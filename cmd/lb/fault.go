@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/iptools"
+)
+
+// FaultMatch selects the requests a fault applies to. Every given condition
+// has to hold, an empty match selects all requests.
+type FaultMatch struct {
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// Headers maps header names to the expected values, an empty value only
+	// requires the header to be present.
+	Headers map[string]string `json:"headers,omitempty"`
+	CIDRs []string `json:"cidrs,omitempty"`
+}
+
+// FaultRule delays or aborts a percentage of the matching requests. With
+// both a delay and an abort status the request is aborted after the delay.
+// Requests are aborted with a 4xx or 5xx status.
+type FaultRule struct {
+	Name string `json:"name,omitempty"`
+	Match FaultMatch `json:"match"`
+	Percentage float64 `json:"percentage"`
+	Delay Duration `json:"delay,omitempty"`
+	AbortStatus int `json:"abort_status,omitempty"`
+}
+
+type compiledFault struct {
+	FaultRule
+	clients *iptools.Trie[bool]
+}
+
+type faultSet struct {
+	rules []FaultRule
+	compiled []compiledFault
+}
+
+var activeFaults atomic.Pointer[faultSet]
+
+func init() {
+	activeFaults.Store(&faultSet{rules: []FaultRule{}})
+}
+
+func compileFaults(rules []FaultRule) ([]compiledFault, error) {
+	compiled := make([]compiledFault, 0, len(rules))
+
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprint(i)
+		}
+
+		if rule.Percentage < 0 || rule.Percentage > 100 {
+			return nil, fmt.Errorf("fault %s: percentage %v is not within 0-100", name, rule.Percentage)
+		}
+
+		if rule.Delay < 0 {
+			return nil, fmt.Errorf("fault %s: negative delay", name)
+		}
+
+		// an informational status is followed by the actual response, and
+		// a successful one would not abort anything
+		if rule.AbortStatus != 0 && (rule.AbortStatus < 400 || rule.AbortStatus > 599) {
+			return nil, fmt.Errorf("fault %s: invalid abort status %d", name, rule.AbortStatus)
+		}
+
+		if rule.Delay == 0 && rule.AbortStatus == 0 {
+			return nil, fmt.Errorf("fault %s: neither delay nor abort status is set", name)
+		}
+
+		fault := compiledFault{FaultRule: rule}
+		fault.Name = name
+
+		if len(rule.Match.CIDRs) > 0 {
+			fault.clients = &iptools.Trie[bool]{}
+		}
+
+		for _, cidr := range rule.Match.CIDRs {
+			ipNet, err := parseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("fault %s: %w", name, err)
+			}
+
+			_ = fault.clients.Insert(ipNet, true)
+		}
+
+		compiled = append(compiled, fault)
+	}
+
+	return compiled, nil
+}
+
+// setFaults replaces the active fault rules.
+func setFaults(rules []FaultRule) error {
+	compiled, err := compileFaults(rules)
+	if err != nil {
+		return err
+	}
+
+	if rules == nil {
+		rules = []FaultRule{}
+	}
+
+	activeFaults.Store(&faultSet{rules: rules, compiled: compiled})
+
+	if len(rules) > 0 {
+		log.Printf("Fault injection enabled with %d rules", len(rules))
+	}
+
+	return nil
+}
+
+func (f *compiledFault) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, f.Match.PathPrefix) {
+		return false
+	}
+
+	for name, value := range f.Match.Headers {
+		values, present := r.Header[http.CanonicalHeaderKey(name)]
+
+		if !present {
+			return false
+		}
+
+		if value != "" && !strings.EqualFold(strings.Join(values, ","), value) {
+			return false
+		}
+	}
+
+	return f.clients == nil || f.clients.Contains(clientIP(r))
+}
+
+// injectFault applies the first matching fault rule selected by its
+// percentage and reports whether the request was answered.
+func injectFault(rw http.ResponseWriter, r *http.Request) bool {
+	for _, fault := range activeFaults.Load().compiled {
+		if !fault.matches(r) || rand.Float64() * 100 >= fault.Percentage {
+			continue
+		}
+
+		if *traceEnabled {
+			rw.Header().Set("lb-fault", fault.Name)
+		}
+
+		if fault.Delay > 0 {
+			log.Printf("Fault %s delays request by %s", fault.Name, time.Duration(fault.Delay))
+
+			timer := time.NewTimer(time.Duration(fault.Delay))
+
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return true
+			}
+		}
+
+		if fault.AbortStatus == 0 {
+			return false
+		}
+
+		log.Printf("Fault %s aborts request with %d", fault.Name, fault.AbortStatus)
+		writeError(rw, r, fault.AbortStatus, ReasonFaultInjected, "fault " + fault.Name + " injected")
+
+		return true
+	}
+
+	return false
+}
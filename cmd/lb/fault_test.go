@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withFaults(t *testing.T, rules ...FaultRule) {
+	assert.Nil(t, setFaults(rules))
+	t.Cleanup(func() { _ = setFaults(nil) })
+}
+
+func TestFaultMatch(t *testing.T) {
+	compiled, err := compileFaults([]FaultRule{{
+		Match: FaultMatch{
+			PathPrefix: "/api/",
+			Headers: map[string]string{"x-chaos": "on", "x-user": ""},
+			CIDRs: []string{"10.0.0.0/8"},
+		},
+		Percentage: 100,
+		AbortStatus: http.StatusTeapot,
+	}})
+	assert.Nil(t, err)
+
+	fault := compiled[0]
+
+	request := func(path, remoteAddr string, headers ...string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i + 1])
+		}
+		return r
+	}
+
+	assert.True(t, fault.matches(request("/api/data", "10.1.2.3:5000", "X-Chaos", "ON", "X-User", "bob")))
+	assert.False(t, fault.matches(request("/health", "10.1.2.3:5000", "X-Chaos", "on", "X-User", "bob")), "path")
+	assert.False(t, fault.matches(request("/api/data", "10.1.2.3:5000", "X-Chaos", "off", "X-User", "bob")), "header value")
+	assert.False(t, fault.matches(request("/api/data", "10.1.2.3:5000", "X-Chaos", "on")), "missing header")
+	assert.False(t, fault.matches(request("/api/data", "192.168.0.1:5000", "X-Chaos", "on", "X-User", "bob")), "client CIDR")
+}
+
+func TestCompileFaultsRejectsInvalidRules(t *testing.T) {
+	invalid := []FaultRule{
+		{Percentage: 120, AbortStatus: 500},
+		{Percentage: 10},
+		{Percentage: 10, AbortStatus: 42},
+		{Percentage: 10, AbortStatus: http.StatusEarlyHints},
+		{Percentage: 10, AbortStatus: http.StatusOK},
+		{Percentage: 10, AbortStatus: 600},
+		{Percentage: 10, Delay: Duration(-time.Second)},
+		{Percentage: 10, AbortStatus: 500, Match: FaultMatch{CIDRs: []string{"10.0.0.0/33"}}},
+	}
+
+	for _, rule := range invalid {
+		_, err := compileFaults([]FaultRule{rule})
+		assert.NotNil(t, err, "%+v", rule)
+	}
+}
+
+func TestFaultAbort(t *testing.T) {
+	withPool(t)
+	withTrace(t)
+	withFaults(t, FaultRule{Name: "teapot", Match: FaultMatch{PathPrefix: "/api/"}, Percentage: 100, AbortStatus: http.StatusTeapot})
+
+	rw := httptest.NewRecorder()
+	httpBalancer.Load().ServeHTTP(rw, httptest.NewRequest("GET", "/api/data", nil))
+
+	assert.Equal(t, http.StatusTeapot, rw.Code)
+	assert.Equal(t, ReasonFaultInjected, rw.Header().Get("lb-error"))
+	assert.Equal(t, "teapot", rw.Header().Get("lb-fault"))
+	assert.Equal(t, "application/problem+json", rw.Header().Get("content-type"))
+
+	var problem Problem
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &problem))
+	assert.Equal(t, http.StatusTeapot, problem.Status)
+	assert.Equal(t, ReasonFaultInjected, problem.Reason)
+	assert.Equal(t, "fault teapot injected", problem.Detail)
+
+	rw = httptest.NewRecorder()
+	assert.False(t, injectFault(rw, httptest.NewRequest("GET", "/health", nil)), "unmatched requests pass")
+}
+
+func TestFaultDelay(t *testing.T) {
+	withFaults(t, FaultRule{Percentage: 100, Delay: Duration(50 * time.Millisecond)})
+
+	start := time.Now()
+	answered := injectFault(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.False(t, answered, "delayed requests are forwarded")
+	assert.GreaterOrEqual(t, time.Since(start), 50 * time.Millisecond)
+}
+
+func TestFaultPercentage(t *testing.T) {
+	withFaults(t, FaultRule{Percentage: 25, AbortStatus: http.StatusServiceUnavailable})
+
+	aborted := 0
+	total := 10000
+
+	for range total {
+		if injectFault(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) {
+			aborted += 1
+		}
+	}
+
+	assert.InDelta(t, 0.25, float64(aborted) / float64(total), 0.03)
+}
+
+func TestAdminFaults(t *testing.T) {
+	t.Cleanup(func() { _ = setFaults(nil) })
+
+	server := httptest.NewServer(adminHandler())
+	defer server.Close()
+
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, server.URL + "/faults", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := put(`[{"name": "slow", "percentage": 50, "delay": "200ms"}]`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	rules := activeFaults.Load().rules
+	assert.Len(t, rules, 1)
+	assert.Equal(t, Duration(200 * time.Millisecond), rules[0].Delay)
+
+	resp = put(`[{"percentage": 50}]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Len(t, activeFaults.Load().rules, 1, "invalid rules are not applied")
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL + "/faults", nil)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	assert.Empty(t, activeFaults.Load().rules)
+}
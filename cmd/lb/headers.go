@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const (
+	HeaderAdd = "add"
+	HeaderSet = "set"
+	HeaderRemove = "remove"
+	HeaderRename = "rename"
+)
+
+// HeaderRule changes a header of the forwarded requests or the responses.
+// The value is a template with the fields of headerContext, like
+// "{{.ClientIP}}".
+type HeaderRule struct {
+	Action string `json:"action"`
+	Name string `json:"name"`
+	Value string `json:"value,omitempty"`
+	// To is the new name of a renamed header.
+	To string `json:"to,omitempty"`
+}
+
+// HeaderRules are applied in order to the request before it is forwarded
+// and to the response before it is copied back to the client.
+type HeaderRules struct {
+	Request []HeaderRule `json:"request"`
+	Response []HeaderRule `json:"response"`
+}
+
+type headerContext struct {
+	ClientIP string
+	Backend string
+	RequestID string
+	// Time is formatted as RFC 3339.
+	Time string
+}
+
+type compiledHeaderRule struct {
+	HeaderRule
+	value *template.Template
+}
+
+type headerRewriter struct {
+	request []compiledHeaderRule
+	response []compiledHeaderRule
+}
+
+var activeHeaderRules atomic.Pointer[headerRewriter]
+
+func init() {
+	activeHeaderRules.Store(&headerRewriter{})
+}
+
+func compileHeaderRules(rules []HeaderRule) ([]compiledHeaderRule, error) {
+	compiled := make([]compiledHeaderRule, 0, len(rules))
+
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("header rule %s without name", rule.Action)
+		}
+
+		switch rule.Action {
+		case HeaderAdd, HeaderSet, HeaderRemove:
+		case HeaderRename:
+			if rule.To == "" {
+				return nil, fmt.Errorf("rename of header %s without new name", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown header action %#v", rule.Action)
+		}
+
+		value, err := template.New(rule.Name).Option("missingkey=error").Parse(rule.Value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", rule.Name, err)
+		}
+
+		// unknown fields are only reported on execution
+		if err := value.Execute(&strings.Builder{}, headerContext{}); err != nil {
+			return nil, fmt.Errorf("header %s: %w", rule.Name, err)
+		}
+
+		compiled = append(compiled, compiledHeaderRule{HeaderRule: rule, value: value})
+	}
+
+	return compiled, nil
+}
+
+func (h *HeaderRules) Validate() error {
+	if _, err := compileHeaderRules(h.Request); err != nil {
+		return err
+	}
+
+	_, err := compileHeaderRules(h.Response)
+	return err
+}
+
+// setHeaderRules replaces the active header rules.
+func setHeaderRules(rules HeaderRules) error {
+	request, err := compileHeaderRules(rules.Request)
+	if err != nil {
+		return err
+	}
+
+	response, err := compileHeaderRules(rules.Response)
+	if err != nil {
+		return err
+	}
+
+	activeHeaderRules.Store(&headerRewriter{request: request, response: response})
+
+	return nil
+}
+
+func newHeaderContext(r *http.Request, backend string) headerContext {
+	return headerContext{
+		ClientIP: clientHost(r.RemoteAddr),
+		Backend: backend,
+		RequestID: requestID(r),
+		Time: time.Now().Format(time.RFC3339),
+	}
+}
+
+func rewriteHeaders(header http.Header, rules []compiledHeaderRule, ctx headerContext) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case HeaderRemove:
+			header.Del(rule.Name)
+			continue
+		case HeaderRename:
+			values := header.Values(rule.Name)
+			header.Del(rule.Name)
+
+			for _, value := range values {
+				header.Add(rule.To, value)
+			}
+			continue
+		}
+
+		value := &strings.Builder{}
+		if err := rule.value.Execute(value, ctx); err != nil {
+			continue
+		}
+
+		if rule.Action == HeaderAdd {
+			header.Add(rule.Name, value.String())
+		} else {
+			header.Set(rule.Name, value.String())
+		}
+	}
+}
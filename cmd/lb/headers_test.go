@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteHeaders(t *testing.T) {
+	rules, err := compileHeaderRules([]HeaderRule{
+		{Action: HeaderRemove, Name: "Server"},
+		{Action: HeaderSet, Name: "lb-author", Value: "balancer"},
+		{Action: HeaderAdd, Name: "Via", Value: "lb {{.Backend}}"},
+		{Action: HeaderRename, Name: "X-Old", To: "X-New"},
+		{Action: HeaderSet, Name: "X-Client", Value: "{{.ClientIP}}/{{.RequestID}}"},
+	})
+	assert.Nil(t, err)
+
+	header := http.Header{}
+	header.Set("Server", "backend/1.0")
+	header.Set("lb-author", "client")
+	header.Set("Via", "proxy")
+	header.Add("X-Old", "a")
+	header.Add("X-Old", "b")
+
+	rewriteHeaders(header, rules, headerContext{ClientIP: "10.0.0.1", Backend: "server1:8080", RequestID: "abc"})
+
+	assert.Empty(t, header.Get("Server"))
+	assert.Equal(t, "balancer", header.Get("lb-author"))
+	assert.Equal(t, []string{"proxy", "lb server1:8080"}, header.Values("Via"))
+	assert.Empty(t, header.Values("X-Old"))
+	assert.Equal(t, []string{"a", "b"}, header.Values("X-New"))
+	assert.Equal(t, "10.0.0.1/abc", header.Get("X-Client"))
+}
+
+func TestCompileHeaderRulesRejectsInvalidRules(t *testing.T) {
+	invalid := []HeaderRule{
+		{Action: "replace", Name: "X-A"},
+		{Action: HeaderSet},
+		{Action: HeaderRename, Name: "X-A"},
+		{Action: HeaderSet, Name: "X-A", Value: "{{.Client"},
+		{Action: HeaderSet, Name: "X-A", Value: "{{.Unknown}}"},
+	}
+
+	for _, rule := range invalid {
+		_, err := compileHeaderRules([]HeaderRule{rule})
+		assert.NotNil(t, err, "%+v", rule)
+	}
+}
+
+func TestForwardRewritesHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Server", "backend/1.0")
+		rw.Header().Set("X-Author", r.Header.Get("lb-author"))
+	}))
+	defer backend.Close()
+
+	assert.Nil(t, setHeaderRules(HeaderRules{
+		Request: []HeaderRule{{Action: HeaderSet, Name: "lb-author", Value: "{{.ClientIP}}"}},
+		Response: []HeaderRule{
+			{Action: HeaderRemove, Name: "Server"},
+			{Action: HeaderSet, Name: "X-Content-Type-Options", Value: "nosniff"},
+		},
+	}))
+	t.Cleanup(func() { _ = setHeaderRules(HeaderRules{}) })
+
+	req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	req.RemoteAddr = "10.0.0.7:4000"
+
+	rw := httptest.NewRecorder()
+	forward(backend.Listener.Addr().String(), rw, req)
+
+	assert.Equal(t, "10.0.0.7", rw.Header().Get("X-Author"))
+	assert.Empty(t, rw.Header().Get("Server"))
+	assert.Equal(t, "nosniff", rw.Header().Get("X-Content-Type-Options"))
+}
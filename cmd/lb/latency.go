@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+)
+
+var (
+	strategy = flag.String("strategy", "hash", "how a backend is picked among the candidates: hash, peak-ewma or affinity")
+	ewmaDecay = flag.Duration("ewma-decay", 10 * time.Second, "time over which a backend latency loses most of its weight with the peak-ewma strategy")
+	ewmaAffinity = flag.Float64("ewma-affinity", 0, "keep clients on their hashed backend while its expected latency is within this factor of the lowest, 0 to only break ties by hash")
+)
+
+// latencyStrategy is configured from the flags in main.
+var latencyStrategy = balancer.NewPeakEWMA(10 * time.Second, 0)
+
+func latencyAware() bool {
+	return *strategy == "peak-ewma"
+}
+
+// frontendStrategy picks the backends of the HTTP mode and feeds the
+// latency strategy with their response times.
+type frontendStrategy struct{}
+
+func (frontendStrategy) Pick(r *http.Request, servers []string) string {
+	return availableServer(r.RemoteAddr, r.Header.Get(versionHeader), servers)
+}
+
+func (frontendStrategy) Started(server string) {
+	if latencyAware() {
+		latencyStrategy.Started(server)
+	}
+}
+
+func (frontendStrategy) Finished(server string, latency time.Duration, failed bool) {
+	if latencyAware() {
+		latencyStrategy.Finished(server, latency, failed)
+	}
+}
+
+// fastestServer picks the candidate with the lowest expected latency among
+// the ones accepting the client. Backends slowly starting take only their
+// share of the clients, as they have no latency to be judged by yet.
+func fastestServer(addr string, candidates []string, now time.Time) string {
+	accepting := slices.DeleteFunc(slices.Clone(candidates), func(server string) bool {
+		backend, known := Backends[server]
+		return known && !backend.acceptsKey(addr, now)
+	})
+
+	if len(accepting) == 0 {
+		accepting = candidates
+	}
+
+	return latencyStrategy.Choose(addr, accepting)
+}
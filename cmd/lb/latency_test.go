@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+	"github.com/stretchr/testify/assert"
+)
+
+func withLatencyStrategy(t *testing.T, affinity float64) {
+	savedStrategy, savedLatency := *strategy, latencyStrategy
+	*strategy = "peak-ewma"
+	latencyStrategy = balancer.NewPeakEWMA(time.Minute, affinity)
+
+	t.Cleanup(func() {
+		*strategy = savedStrategy
+		latencyStrategy = savedLatency
+	})
+}
+
+// delayedBackend answers after the delay, like a server started with
+// CONF_RESPONSE_DELAY_SEC, and counts its requests.
+func delayedBackend(delay time.Duration, hits *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(delay)
+		_, _ = rw.Write([]byte("ok"))
+	}))
+}
+
+func TestLatencyAwareBalancing(t *testing.T) {
+	var slowHits, fastHits atomic.Int64
+
+	slow := delayedBackend(50 * time.Millisecond, &slowHits)
+	defer slow.Close()
+	fast1 := delayedBackend(0, &fastHits)
+	defer fast1.Close()
+	fast2 := delayedBackend(0, &fastHits)
+	defer fast2.Close()
+
+	withPool(t, slow.Listener.Addr().String(), fast1.Listener.Addr().String(), fast2.Listener.Addr().String())
+	withLatencyStrategy(t, 0)
+
+	clients := 150
+
+	for i := 0; i < clients; i++ {
+		r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+		r.RemoteAddr = fmt.Sprintf("10.3.0.%d:4000", i)
+
+		rw := httptest.NewRecorder()
+		httpBalancer.Load().ServeHTTP(rw, r)
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+
+	// hashing alone would send about a third of the clients to it
+	assert.Less(t, slowHits.Load(), int64(clients / 10), "traffic moves away from the slow backend")
+	assert.Equal(t, int64(clients), slowHits.Load() + fastHits.Load())
+	assert.Greater(t, latencyStrategy.Cost(slow.Listener.Addr().String()), 40 * time.Millisecond)
+}
+
+func TestLatencyAwareAffinity(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	withLatencyStrategy(t, 2)
+
+	withSlowStart(t, 0)
+
+	latencyStrategy.Finished("a:8080", 15 * time.Millisecond, false)
+	latencyStrategy.Finished("b:8080", 10 * time.Millisecond, false)
+
+	res := shares(1000)
+	assert.Len(t, res, 2, "clients keep their backend while it is not much slower")
+
+	latencyStrategy.Finished("a:8080", 50 * time.Millisecond, false)
+
+	res = shares(1000)
+	assert.Equal(t, map[string]int{"b:8080": 1000}, res)
+}
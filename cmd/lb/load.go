@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/httptools"
+)
+
+var (
+	loadFeedback = flag.Bool("load-feedback", false, "adjust the weights of the backends from the load they report on health checks")
+	loadWeightStep = flag.Float64("load-weight-step", 0.25, "change of a reported weight, as a share of the full one, needed to move clients of the backend and the lowest weight kept, 0 to follow every report")
+)
+
+// maxHealthBody bounds the health check bodies read for a load report.
+const maxHealthBody = 64 * 1024
+
+// reportedLoad reads the load a backend reported on a health check, from
+// httptools.LoadHeader or else from a JSON body.
+func reportedLoad(resp *http.Response) (*httptools.Load, bool) {
+	if value := resp.Header.Get(httptools.LoadHeader); value != "" {
+		load, err := httptools.ParseLoad(value)
+		return &load, err == nil
+	}
+
+	if !strings.Contains(resp.Header.Get("content-type"), "application/json") {
+		return nil, false
+	}
+
+	// the weight shadows the one of the load, so a body without it is not
+	// taken for a backend asking for no traffic
+	body := struct {
+		httptools.Load
+		Weight *float64 `json:"weight"`
+	}{}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxHealthBody)).Decode(&body); err != nil || body.Weight == nil {
+		return nil, false
+	}
+
+	load := body.Load
+	load.Weight = *body.Weight
+
+	return &load, true
+}
+
+// backendLoad is the last load reported by a backend and the weight given
+// to it for that.
+type backendLoad struct {
+	report httptools.Load
+	weight float64
+}
+
+// reportLoad remembers the load of the last health check, nil once the
+// backend stopped reporting it. Every change of the weight moves clients
+// between backends, so it only follows reports differing from it by the
+// weight step, rounded to a multiple of the step. The weight never drops
+// below the step, so a busy backend keeps at least that share of its
+// clients instead of losing all of them at once.
+func (b *Backend) reportLoad(load *httptools.Load) {
+	if load == nil {
+		b.load.Store(nil)
+		return
+	}
+
+	reported := min(max(load.Weight / 100, 0), 1)
+	weight := 1.0
+
+	if previous := b.load.Load(); previous != nil {
+		weight = previous.weight
+	}
+
+	step := *loadWeightStep
+
+	if step <= 0 {
+		weight = reported
+	} else if math.Abs(reported - weight) >= step {
+		weight = max(math.Round(reported / step) * step, step)
+	}
+
+	b.load.Store(&backendLoad{report: *load, weight: min(weight, 1)})
+}
+
+func (b *Backend) Load() *httptools.Load {
+	if load := b.load.Load(); load != nil {
+		return &load.report
+	}
+
+	return nil
+}
+
+// loadWeight is the share of its traffic the backend asked for.
+func (b *Backend) loadWeight() float64 {
+	load := b.load.Load()
+
+	if load == nil || !*loadFeedback {
+		return 1
+	}
+
+	return load.weight
+}
+
+// effectiveWeight is the share of its hashed traffic the backend accepts.
+func (b *Backend) effectiveWeight(now time.Time) float64 {
+	return b.rampWeight(now) * b.loadWeight()
+}
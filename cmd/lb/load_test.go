@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/magicvegetable/architecture-lab-4/httptools"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadedBackend answers health checks with the load, in its header or in
+// a JSON body.
+func loadedBackend(load httptools.Load, header bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if header {
+			rw.Header().Set(httptools.LoadHeader, load.String())
+			_, _ = rw.Write([]byte("OK"))
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, load)
+	}))
+}
+
+func withLoadFeedback(t *testing.T) {
+	withFlag(t, loadFeedback, true)
+}
+
+func TestHealthReadsLoad(t *testing.T) {
+	withLoadFeedback(t)
+
+	fromHeader := loadedBackend(httptools.Load{CPU: 0.5, Weight: 50}, true)
+	defer fromHeader.Close()
+	fromBody := loadedBackend(httptools.Load{Queue: 3, InFlight: 7, Weight: 25}, false)
+	defer fromBody.Close()
+
+	headerAddr, bodyAddr := fromHeader.Listener.Addr().String(), fromBody.Listener.Addr().String()
+	withPool(t, headerAddr, bodyAddr)
+
+	assert.True(t, health(headerAddr))
+	assert.True(t, health(bodyAddr))
+
+	assert.Equal(t, &httptools.Load{CPU: 0.5, Weight: 50}, Backends[headerAddr].Load())
+	assert.Equal(t, &httptools.Load{Queue: 3, InFlight: 7, Weight: 25}, Backends[bodyAddr].Load())
+	assert.Equal(t, 0.25, Backends[bodyAddr].loadWeight())
+
+	fromBody.Close()
+
+	assert.False(t, health(bodyAddr))
+	assert.Nil(t, Backends[bodyAddr].Load(), "a failed check forgets the load")
+	assert.Equal(t, 1.0, Backends[bodyAddr].loadWeight())
+}
+
+func TestLoadWeightedBalancing(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	withLoadFeedback(t)
+	withSlowStart(t, 0)
+
+	Backends["a:8080"].reportLoad(&httptools.Load{Weight: 50})
+
+	res := shares(1000)
+	assert.InDelta(t, 250, res["a:8080"], 50, "half of its hashed clients stay on the loaded backend")
+	assert.Equal(t, 1000, res["a:8080"] + res["b:8080"])
+
+	*loadFeedback = false
+
+	res = shares(1000)
+	assert.InDelta(t, 500, res["a:8080"], 50, "reported load is ignored without load feedback")
+}
+
+func TestLoadWeightKeepsClients(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	withLoadFeedback(t)
+	withSlowStart(t, 0)
+
+	backend := Backends["a:8080"]
+	before := clientBackends("10.0", 3000)
+
+	// a busy backend reports a slightly different weight on every check
+	for _, weight := range []float64{97, 94, 99, 81} {
+		backend.reportLoad(&httptools.Load{CPU: 1 - weight / 100, Weight: weight})
+		assert.Equal(t, before, clientBackends("10.0", 3000), "weight %.0f moves no client", weight)
+	}
+
+	backend.reportLoad(&httptools.Load{Weight: 60})
+	assert.Equal(t, 0.5, backend.loadWeight())
+
+	moved := clientBackends("10.0", 3000)
+	assert.NotEqual(t, before, moved)
+
+	backend.reportLoad(&httptools.Load{Weight: 70})
+	assert.Equal(t, moved, clientBackends("10.0", 3000), "the weight only follows large changes")
+
+	backend.reportLoad(&httptools.Load{Weight: 0})
+	assert.Equal(t, *loadWeightStep, backend.loadWeight(), "a busy backend keeps a step of its share")
+
+	backend.reportLoad(nil)
+	assert.Equal(t, before, clientBackends("10.0", 3000), "a backend without reports takes its full share")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const rateWindowSec = 60
+
+// rateCounter counts events in per-second buckets over the last minute.
+// Concurrent updates of a bucket being reset may lose a few events, which
+// is fine for the statistics it serves.
+type rateCounter struct {
+	buckets [rateWindowSec]atomic.Int64
+	stamps [rateWindowSec]atomic.Int64
+}
+
+func (c *rateCounter) Add(now time.Time) {
+	sec := now.Unix()
+	i := sec % rateWindowSec
+
+	if stamp := c.stamps[i].Load(); stamp != sec && c.stamps[i].CompareAndSwap(stamp, sec) {
+		c.buckets[i].Store(0)
+	}
+
+	c.buckets[i].Add(1)
+}
+
+// Rate is the average amount of events per second over the given window,
+// not counting the current, incomplete second.
+func (c *rateCounter) Rate(now time.Time, windowSec int64) float64 {
+	if windowSec > rateWindowSec - 1 {
+		windowSec = rateWindowSec - 1
+	}
+
+	sec := now.Unix()
+	total := int64(0)
+
+	for past := sec - windowSec; past < sec; past++ {
+		i := past % rateWindowSec
+
+		if c.stamps[i].Load() == past {
+			total += c.buckets[i].Load()
+		}
+	}
+
+	return float64(total) / float64(windowSec)
+}
+
+type backendMetrics struct {
+	requests rateCounter
+	errors rateCounter
+
+	lastCheck atomic.Int64
+	lastCheckLatency atomic.Int64
+	lastCheckOK atomic.Bool
+
+	lastDied atomic.Int64
+	lastResurrected atomic.Int64
+}
+
+func (m *backendMetrics) recordRequest(failed bool) {
+	now := time.Now()
+
+	m.requests.Add(now)
+
+	if failed {
+		m.errors.Add(now)
+	}
+}
+
+func (m *backendMetrics) recordCheck(start time.Time, latency time.Duration, alive bool) {
+	m.lastCheck.Store(start.UnixNano())
+	m.lastCheckLatency.Store(int64(latency))
+	m.lastCheckOK.Store(alive)
+}
+
+func unixNanoTime(nano int64) *time.Time {
+	if nano == 0 {
+		return nil
+	}
+
+	t := time.Unix(0, nano)
+	return &t
+}
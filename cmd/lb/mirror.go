@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+)
+
+// MirrorConfig copies a percentage of the requests to a shadow pool, whose
+// responses are only logged next to the primary ones.
+type MirrorConfig struct {
+	Backends []string `json:"backends"`
+	Percentage float64 `json:"percentage"`
+	// MaxBodyBytes skips mirroring requests with larger bodies.
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// MaxInFlight skips mirroring while this many shadow requests are active.
+	MaxInFlight int64 `json:"max_in_flight,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+const (
+	defaultMirrorMaxBodyBytes = 1 << 20
+	defaultMirrorMaxInFlight = 100
+	defaultMirrorTimeout = Duration(5 * time.Second)
+)
+
+func (c *MirrorConfig) Validate() error {
+	if c.Percentage < 0 || c.Percentage > 100 {
+		return fmt.Errorf("mirror percentage %v is not within 0-100", c.Percentage)
+	}
+
+	if c.Percentage > 0 && len(c.Backends) == 0 {
+		return fmt.Errorf("mirror without backends")
+	}
+
+	if c.MaxBodyBytes < 0 || c.MaxInFlight < 0 || c.Timeout < 0 {
+		return fmt.Errorf("negative mirror limits")
+	}
+
+	return nil
+}
+
+var (
+	activeMirror atomic.Pointer[MirrorConfig]
+	mirrorsInFlight atomic.Int64
+)
+
+func init() {
+	activeMirror.Store(&MirrorConfig{})
+}
+
+// setMirror fills in the defaults and makes the mirror configuration active.
+func setMirror(config MirrorConfig) {
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = defaultMirrorMaxBodyBytes
+	}
+
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = defaultMirrorMaxInFlight
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = defaultMirrorTimeout
+	}
+
+	activeMirror.Store(&config)
+
+	if config.Percentage > 0 {
+		log.Printf("Mirroring %v%% of requests to %v", config.Percentage, config.Backends)
+	}
+}
+
+type mirrorResult struct {
+	status int
+	latency time.Duration
+}
+
+// startMirror sends a copy of the request to a shadow backend if it is
+// selected for mirroring. The primary result has to be sent to the returned
+// channel, which is nil for requests not mirrored.
+func startMirror(r *http.Request) chan<- mirrorResult {
+	config := activeMirror.Load()
+
+	if config.Percentage == 0 || rand.Float64() * 100 >= config.Percentage {
+		return nil
+	}
+
+	if mirrorsInFlight.Load() >= config.MaxInFlight {
+		log.Printf("Skipping mirror of %s: too many shadow requests", requestID(r))
+		return nil
+	}
+
+	// the body is read only once, so both requests get a buffered copy
+	body, err := io.ReadAll(io.LimitReader(r.Body, config.MaxBodyBytes + 1))
+	if err != nil {
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		return nil
+	}
+
+	if int64(len(body)) > config.MaxBodyBytes {
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		log.Printf("Skipping mirror of %s: body is over %d bytes", requestID(r), config.MaxBodyBytes)
+		return nil
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	dst := config.Backends[balancer.Hash(r.RemoteAddr) % uint64(len(config.Backends))]
+
+	// the shadow request must not be cancelled with the primary one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout))
+
+	shadowRequest := r.Clone(ctx)
+	shadowRequest.RequestURI = ""
+	shadowRequest.URL.Host = dst
+	shadowRequest.URL.Scheme = scheme()
+	shadowRequest.Host = dst
+	shadowRequest.Body = io.NopCloser(bytes.NewReader(body))
+	shadowRequest.ContentLength = int64(len(body))
+	shadowRequest.Header.Set("lb-shadow", "true")
+
+	id := requestID(r)
+	primary := make(chan mirrorResult, 1)
+	mirrorsInFlight.Add(1)
+
+	go func() {
+		defer mirrorsInFlight.Add(-1)
+		defer cancel()
+
+		start := time.Now()
+		resp, err := clientFor(dst).Do(shadowRequest)
+		latency := time.Since(start)
+
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		result := <-primary
+
+		if err != nil {
+			log.Printf("mirror %s primary %d in %s, shadow %s failed in %s: %s",
+				id, result.status, result.latency, dst, latency, err)
+			return
+		}
+
+		log.Printf("mirror %s primary %d in %s, shadow %s %d in %s",
+			id, result.status, result.latency, dst, resp.StatusCode, latency)
+	}()
+
+	return primary
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withMirror(t *testing.T, config MirrorConfig) {
+	setMirror(config)
+	t.Cleanup(func() { setMirror(MirrorConfig{}) })
+}
+
+type shadowRequest struct {
+	header http.Header
+	body string
+}
+
+func httpEchoBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(rw, r.Body)
+	}))
+}
+
+func shadowBackend(delay time.Duration) (*httptest.Server, chan shadowRequest) {
+	received := make(chan shadowRequest, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		time.Sleep(delay)
+		received <- shadowRequest{header: r.Header, body: string(body)}
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	return server, received
+}
+
+func TestMirror(t *testing.T) {
+	primary := httpEchoBackend()
+	defer primary.Close()
+
+	shadow, received := shadowBackend(0)
+	defer shadow.Close()
+
+	withPool(t, primary.Listener.Addr().String())
+	withMirror(t, MirrorConfig{Backends: []string{shadow.Listener.Addr().String()}, Percentage: 100})
+
+	rw := httptest.NewRecorder()
+	httpBalancer.Load().ServeHTTP(rw, httptest.NewRequest("POST", "/api/v1/some-data", strings.NewReader("payload")))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "payload", rw.Body.String(), "the primary gets the whole body")
+
+	select {
+	case request := <-received:
+		assert.Equal(t, "payload", request.body)
+		assert.Equal(t, "true", request.header.Get("lb-shadow"))
+		assert.NotEmpty(t, request.header.Get(requestIDHeader))
+	case <-time.After(5 * time.Second):
+		t.Fatal("request is not mirrored")
+	}
+}
+
+func TestMirrorDoesNotDelayPrimary(t *testing.T) {
+	primary := httpEchoBackend()
+	defer primary.Close()
+
+	shadow, received := shadowBackend(500 * time.Millisecond)
+	defer shadow.Close()
+
+	withPool(t, primary.Listener.Addr().String())
+	withMirror(t, MirrorConfig{Backends: []string{shadow.Listener.Addr().String()}, Percentage: 100})
+
+	start := time.Now()
+	httpBalancer.Load().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.Less(t, time.Since(start), 400 * time.Millisecond)
+	<-received
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	primary := httpEchoBackend()
+	defer primary.Close()
+
+	shadow, received := shadowBackend(0)
+	defer shadow.Close()
+
+	withPool(t, primary.Listener.Addr().String())
+	withMirror(t, MirrorConfig{Backends: []string{shadow.Listener.Addr().String()}, Percentage: 100, MaxBodyBytes: 4})
+
+	rw := httptest.NewRecorder()
+	httpBalancer.Load().ServeHTTP(rw, httptest.NewRequest("POST", "/", strings.NewReader("too large")))
+
+	assert.Equal(t, "too large", rw.Body.String())
+
+	select {
+	case <-received:
+		t.Fatal("large body is mirrored")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorConfigValidate(t *testing.T) {
+	assert.Nil(t, (&MirrorConfig{}).Validate())
+	assert.NotNil(t, (&MirrorConfig{Percentage: 10}).Validate())
+	assert.NotNil(t, (&MirrorConfig{Backends: []string{"a:8080"}, Percentage: 101}).Validate())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"slices"
+	"sync/atomic"
+)
+
+var panicThreshold = flag.Float64("panic-threshold", 0, "percentage of healthy backends below which traffic goes to all of them regardless of health, 0 to disable")
+
+// panicking is set while requests are spread over the unhealthy backends.
+var panicking atomic.Bool
+
+// panicPool returns the whole pool if too few of its backends are healthy.
+// A mass failure of the health checks is more likely a network blip than
+// dead backends, and the few healthy ones would collapse under all of the
+// traffic. Backends drained or in maintenance are never used.
+func panicPool(healthy []string) ([]string, bool) {
+	threshold := *panicThreshold
+
+	// the backends in maintenance only lower the share, so most of the
+	// time the pool is healthy enough without looking at them
+	if threshold <= 0 || float64(len(healthy)) * 100 >= threshold * float64(len(Backends)) {
+		return healthy, false
+	}
+
+	var all []string
+	for address, backend := range Backends {
+		if state := backend.State(); state == StateHealthy || state == StateUnhealthy {
+			all = append(all, address)
+		}
+	}
+
+	if len(all) == 0 || float64(len(healthy)) * 100 >= threshold * float64(len(all)) {
+		return healthy, false
+	}
+
+	// the map order is random, while clients have to hash to the same backend
+	slices.Sort(all)
+
+	return all, true
+}
+
+// balancedServers is the pool requests are balanced over, logging when the
+// balancer enters or leaves the panic mode.
+func balancedServers(healthy []string) ([]string, bool) {
+	servers, panicked := panicPool(healthy)
+
+	// every request passes here, so the flag is only written when the mode
+	// changes, and only the request winning the swap logs it
+	if panicking.Load() != panicked && panicking.CompareAndSwap(!panicked, panicked) {
+		if panicked {
+			log.Printf("Panic mode: only %d of %d backends are healthy, balancing over all of them", len(healthy), len(servers))
+		} else {
+			log.Printf("Panic mode is over: %d backends are healthy", len(healthy))
+		}
+	}
+
+	return servers, panicked
+}
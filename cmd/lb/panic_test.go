@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var panicServersAll = []string{"p1:8080", "p2:8080", "p3:8080", "p4:8080"}
+
+func withPanicThreshold(t *testing.T, threshold float64) {
+	saved := *panicThreshold
+	*panicThreshold = threshold
+	t.Cleanup(func() {
+		*panicThreshold = saved
+		panicking.Store(false)
+	})
+}
+
+// pickedServers spreads clients over the pool and returns the servers picked.
+func pickedServers() map[string]int {
+	picked := map[string]int{}
+
+	for i := 0; i < 1000; i++ {
+		picked[GetAvailableServer(fmt.Sprintf("10.2.%d.%d:4000", i / 256, i % 256))] += 1
+	}
+
+	return picked
+}
+
+func TestPanicThreshold(t *testing.T) {
+	withPool(t, panicServersAll...)
+	withPanicThreshold(t, 50)
+	withSlowStart(t, 0)
+	withAlive(t, panicServersAll...)
+	withFlag(t, &CheckServerHealthInterval, time.Millisecond)
+
+	monitorServers(t, HealthMock)
+
+	poolSize := func(size int) func() bool {
+		return func() bool { return len(ServersPool()) == size }
+	}
+
+	killServer("p1:8080")
+	assert.Eventually(t, poolSize(3), time.Second, time.Millisecond)
+
+	assert.NotContains(t, pickedServers(), "p1:8080", "half of the backends are healthy, no panic yet")
+	assert.False(t, panicking.Load())
+
+	killServer("p2:8080")
+	killServer("p3:8080")
+	assert.Eventually(t, poolSize(1), time.Second, time.Millisecond)
+
+	picked := pickedServers()
+	assert.Len(t, picked, len(panicServersAll), "traffic goes to the whole pool in panic mode")
+	assert.True(t, panicking.Load())
+
+	rw := httptest.NewRecorder()
+	adminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/status.json", nil))
+	assert.Contains(t, rw.Body.String(), `"panic":true`)
+
+	resurrectServer("p1:8080")
+	resurrectServer("p2:8080")
+	assert.Eventually(t, poolSize(3), time.Second, time.Millisecond)
+
+	assert.NotContains(t, pickedServers(), "p3:8080", "unhealthy backends are left out again")
+	assert.False(t, panicking.Load())
+}
+
+func TestPanicSkipsMaintenance(t *testing.T) {
+	withPool(t, panicServersAll...)
+	withPanicThreshold(t, 50)
+
+	Backends["p1:8080"].Transition(StateMaintenance, StateHealthy)
+	Backends["p2:8080"].Transition(StateUnhealthy, StateHealthy)
+	Backends["p3:8080"].Transition(StateUnhealthy, StateHealthy)
+
+	servers, panicked := panicPool(ServersPool())
+
+	assert.True(t, panicked)
+	assert.Equal(t, []string{"p2:8080", "p3:8080", "p4:8080"}, servers)
+
+	_, panicked = panicPool(nil)
+	assert.True(t, panicked, "no healthy backend at all")
+
+	withPanicThreshold(t, 0)
+	_, panicked = panicPool(nil)
+	assert.False(t, panicked, "panic mode is disabled")
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+)
+
+// DefaultServers are the backends balanced between at startup.
+var DefaultServers = []string{
+	"server1:8080",
+	"server2:8080",
+	"server3:8080",
+}
+
+var (
+	pool = balancer.NewPool(DefaultServers...)
+	// serversM keeps the backend states in step with the pool, readers
+	// never take it
+	serversM = sync.Mutex{}
+)
+
+// ServersPool returns the backends currently receiving traffic. The slice
+// is shared with other readers and must not be modified.
+func ServersPool() []string {
+	return pool.Servers()
+}
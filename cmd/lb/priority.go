@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+)
+
+// TierConfig puts backends on a priority level, 0 being the highest.
+// Backends not in any tier are on level 0.
+type TierConfig struct {
+	Name string `json:"name"`
+	Priority int `json:"priority"`
+	Backends []string `json:"backends"`
+}
+
+// PriorityConfig sends the traffic to the highest level with enough healthy
+// backends. A level takes all of its traffic while at least Capacity percent
+// of its backends are healthy. Below that, the missing share overflows to
+// the next level. A backend coming back counts towards the capacity of its
+// level only once it has stayed healthy for Recovery, so traffic does not
+// bounce between the levels while it flaps.
+type PriorityConfig struct {
+	Tiers []TierConfig `json:"tiers"`
+	Capacity float64 `json:"capacity,omitempty"`
+	Recovery Duration `json:"recovery,omitempty"`
+}
+
+const (
+	defaultPriorityCapacity = 70
+	defaultPriorityRecovery = Duration(30 * time.Second)
+)
+
+func (c *PriorityConfig) Validate() error {
+	if c.Capacity < 0 || c.Capacity > 100 {
+		return fmt.Errorf("priority capacity %v is not within 0-100", c.Capacity)
+	}
+
+	if c.Recovery < 0 {
+		return fmt.Errorf("negative priority recovery")
+	}
+
+	names := map[string]bool{}
+	owners := map[string]string{}
+
+	for _, tier := range c.Tiers {
+		if tier.Name == "" {
+			return fmt.Errorf("tier without name")
+		}
+
+		if names[tier.Name] {
+			return fmt.Errorf("duplicate tier %s", tier.Name)
+		}
+		names[tier.Name] = true
+
+		if tier.Priority < 0 {
+			return fmt.Errorf("tier %s: negative priority", tier.Name)
+		}
+
+		for _, address := range tier.Backends {
+			if _, known := Backends[address]; !known {
+				return fmt.Errorf("tier %s: unknown backend %s", tier.Name, address)
+			}
+
+			if owner, owned := owners[address]; owned {
+				return fmt.Errorf("backend %s is in tiers %s and %s", address, owner, tier.Name)
+			}
+			owners[address] = tier.Name
+		}
+	}
+
+	return nil
+}
+
+// priorityLevels are the backends grouped by priority, highest first.
+type priorityLevels struct {
+	config PriorityConfig
+	priorities []int
+	sizes []int
+	levelOf map[string]int
+}
+
+var activePriorities atomic.Pointer[priorityLevels]
+
+func init() {
+	activePriorities.Store(&priorityLevels{})
+}
+
+// setPriorities fills in the defaults and groups the backends by priority.
+func setPriorities(config PriorityConfig) {
+	if config.Capacity == 0 {
+		config.Capacity = defaultPriorityCapacity
+	}
+
+	if config.Recovery == 0 {
+		config.Recovery = defaultPriorityRecovery
+	}
+
+	priorityOf := map[string]int{}
+	for _, tier := range config.Tiers {
+		for _, address := range tier.Backends {
+			priorityOf[address] = tier.Priority
+		}
+	}
+
+	levels := &priorityLevels{config: config, levelOf: map[string]int{}}
+
+	for address := range Backends {
+		if !slices.Contains(levels.priorities, priorityOf[address]) {
+			levels.priorities = append(levels.priorities, priorityOf[address])
+		}
+	}
+	slices.Sort(levels.priorities)
+
+	levels.sizes = make([]int, len(levels.priorities))
+
+	for address := range Backends {
+		level := slices.Index(levels.priorities, priorityOf[address])
+		levels.levelOf[address] = level
+		levels.sizes[level] += 1
+	}
+
+	activePriorities.Store(levels)
+
+	if len(levels.priorities) > 1 {
+		log.Printf("Balancing over %d priority levels", len(levels.priorities))
+	}
+}
+
+// recovered reports whether the backend has been healthy long enough to
+// count towards the capacity of its level. Backends that never left the
+// pool count right away.
+func (b *Backend) recovered(recovery time.Duration, now time.Time) bool {
+	start := b.rampStart.Load()
+
+	return start == 0 || now.Sub(time.Unix(0, start)) >= recovery
+}
+
+// loads returns the share of the traffic of every level given the healthy
+// backends. The shares add up to less than 1 when every level is degraded.
+func (l *priorityLevels) loads(healthy []string, now time.Time) []float64 {
+	counted := make([]int, len(l.priorities))
+
+	for _, server := range healthy {
+		level, known := l.levelOf[server]
+
+		if backend := Backends[server]; known && backend.recovered(time.Duration(l.config.Recovery), now) {
+			counted[level] += 1
+		}
+	}
+
+	loads := make([]float64, len(l.priorities))
+	remaining := 1.0
+
+	for level, size := range l.sizes {
+		health := min(1, float64(counted[level]) / float64(size) * 100 / l.config.Capacity)
+
+		loads[level] = min(remaining, health)
+		remaining -= loads[level]
+	}
+
+	return loads
+}
+
+// candidates narrows the healthy backends down to the level of the client.
+// Clients keep their level while the shares do not change, and are the
+// first to move when they do.
+func (l *priorityLevels) candidates(addr string, healthy []string, now time.Time) []string {
+	if len(l.priorities) <= 1 {
+		return healthy
+	}
+
+	loads := l.loads(healthy, now)
+
+	total := 0.0
+	for _, load := range loads {
+		total += load
+	}
+
+	// every healthy backend is still recovering
+	if total == 0 {
+		return healthy
+	}
+
+	point := float64(balancer.Hash(addr + "#priority") % 10000) / 10000 * total
+	chosen := -1
+
+	for level, load := range loads {
+		if load == 0 {
+			continue
+		}
+
+		chosen = level
+
+		if point < load {
+			break
+		}
+
+		point -= load
+	}
+
+	var candidates []string
+	for _, server := range healthy {
+		if level, known := l.levelOf[server]; known && level == chosen {
+			candidates = append(candidates, server)
+		}
+	}
+
+	return candidates
+}
+
+type priorityInfo struct {
+	Priority int `json:"priority"`
+	Backends int `json:"backends"`
+	Share float64 `json:"share"`
+}
+
+func prioritiesInfo() []priorityInfo {
+	levels := activePriorities.Load()
+	loads := levels.loads(ServersPool(), time.Now())
+	infos := []priorityInfo{}
+
+	for level, priority := range levels.priorities {
+		infos = append(infos, priorityInfo{
+			Priority: priority,
+			Backends: levels.sizes[level],
+			Share: loads[level],
+		})
+	}
+
+	return infos
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withPriorities(t *testing.T, config PriorityConfig) {
+	assert.Nil(t, config.Validate())
+	setPriorities(config)
+	t.Cleanup(func() { setPriorities(PriorityConfig{}) })
+
+	withSlowStart(t, 0)
+}
+
+func tiered() PriorityConfig {
+	return PriorityConfig{
+		Tiers: []TierConfig{{Name: "backup", Priority: 1, Backends: []string{"b1:8080", "b2:8080"}}},
+		Recovery: Duration(50 * time.Millisecond),
+	}
+}
+
+func backupShare(res map[string]int, clients int) float64 {
+	return float64(res["b1:8080"] + res["b2:8080"]) / float64(clients)
+}
+
+func TestPrioritiesKeepBackupsIdle(t *testing.T) {
+	withPool(t, "p1:8080", "p2:8080", "p3:8080", "p4:8080", "b1:8080", "b2:8080")
+	withPriorities(t, tiered())
+
+	res := shares(1000)
+
+	assert.Zero(t, backupShare(res, 1000), "no traffic to the backups while the primaries are healthy")
+	assert.Len(t, res, 4)
+}
+
+func TestPrioritiesOverflow(t *testing.T) {
+	withPool(t, "p1:8080", "p2:8080", "p3:8080", "p4:8080", "b1:8080", "b2:8080")
+	withPriorities(t, tiered())
+
+	Backends["p1:8080"].Transition(StateUnhealthy, StateHealthy)
+	Backends["p2:8080"].Transition(StateUnhealthy, StateHealthy)
+
+	// half of the primaries is 0.5 / 0.7 of the capacity they need
+	clients := 10000
+	assert.InDelta(t, 1 - 0.5 / 0.7, backupShare(shares(clients), clients), 0.02)
+
+	Backends["p3:8080"].Transition(StateUnhealthy, StateHealthy)
+	Backends["p4:8080"].Transition(StateUnhealthy, StateHealthy)
+
+	assert.Equal(t, 1.0, backupShare(shares(clients), clients), "everything fails over")
+}
+
+func TestPrioritiesRecovery(t *testing.T) {
+	withPool(t, "p1:8080", "p2:8080", "b1:8080", "b2:8080")
+	withPriorities(t, tiered())
+
+	primary := Backends["p1:8080"]
+	primary.Transition(StateUnhealthy, StateHealthy)
+	Backends["p2:8080"].Transition(StateUnhealthy, StateHealthy)
+
+	clients := 1000
+	assert.Equal(t, 1.0, backupShare(shares(clients), clients))
+
+	// the flapping primary gets no traffic back until it stays healthy
+	for i := 0; i < 3; i++ {
+		primary.Transition(StateHealthy, StateUnhealthy)
+		assert.Equal(t, 1.0, backupShare(shares(clients), clients))
+		primary.Transition(StateUnhealthy, StateHealthy)
+	}
+
+	primary.Transition(StateHealthy, StateUnhealthy)
+	time.Sleep(60 * time.Millisecond)
+
+	res := shares(clients)
+	assert.Less(t, backupShare(res, clients), 1.0)
+	assert.Positive(t, res["p1:8080"])
+}
+
+func TestPriorityConfigValidate(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+
+	assert.Nil(t, (&PriorityConfig{}).Validate())
+
+	invalid := []PriorityConfig{
+		{Capacity: 120},
+		{Tiers: []TierConfig{{Backends: []string{"a:8080"}}}},
+		{Tiers: []TierConfig{{Name: "x", Priority: -1}}},
+		{Tiers: []TierConfig{{Name: "x", Backends: []string{"unknown:8080"}}}},
+		{Tiers: []TierConfig{{Name: "x"}, {Name: "x"}}},
+		{Tiers: []TierConfig{{Name: "x", Backends: []string{"a:8080"}}, {Name: "y", Backends: []string{"a:8080"}}}},
+	}
+
+	for _, config := range invalid {
+		assert.NotNil(t, config.Validate(), "%+v", config)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+var retryAfter = flag.Duration("retry-after", time.Second, "time clients are asked to wait before retrying when no backend is available")
+
+// Reasons of the errors generated by the balancer, reported in the lb-error
+// trace header.
+const (
+	ReasonNoBackend = "no-backend"
+	ReasonUpstreamError = "upstream-error"
+	ReasonUpstreamTimeout = "upstream-timeout"
+	ReasonAccessDenied = "access-denied"
+	ReasonDeadlineExceeded = "deadline-exceeded"
+	ReasonFaultInjected = "fault-injected"
+)
+
+// Problem is an RFC 9457 problem details body.
+type Problem struct {
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Status int `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Reason string `json:"reason"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// ErrorPagesConfig names template files rendering the errors instead of the
+// problem details. The templates get a Problem, the HTML one is used for
+// clients accepting text/html. The JSON one is not escaped on its own, its
+// values have to go through the json function, e.g. {{json .Detail}}.
+type ErrorPagesConfig struct {
+	HTML string `json:"html,omitempty"`
+	JSON string `json:"json,omitempty"`
+}
+
+type errorPages struct {
+	html *htmltemplate.Template
+	json *template.Template
+}
+
+var activeErrorPages atomic.Pointer[errorPages]
+
+// jsonFuncs let the JSON error pages encode the values they embed.
+var jsonFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+func init() {
+	activeErrorPages.Store(&errorPages{})
+}
+
+func compileErrorPages(config ErrorPagesConfig) (*errorPages, error) {
+	pages := &errorPages{}
+
+	if config.HTML != "" {
+		data, err := os.ReadFile(config.HTML)
+		if err != nil {
+			return nil, fmt.Errorf("read html error page: %w", err)
+		}
+
+		if pages.html, err = htmltemplate.New("html").Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("parse html error page %s: %w", config.HTML, err)
+		}
+	}
+
+	if config.JSON != "" {
+		data, err := os.ReadFile(config.JSON)
+		if err != nil {
+			return nil, fmt.Errorf("read json error page: %w", err)
+		}
+
+		if pages.json, err = template.New("json").Funcs(jsonFuncs).Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("parse json error page %s: %w", config.JSON, err)
+		}
+	}
+
+	return pages, nil
+}
+
+func setErrorPages(config ErrorPagesConfig) error {
+	pages, err := compileErrorPages(config)
+	if err != nil {
+		return err
+	}
+
+	activeErrorPages.Store(pages)
+
+	return nil
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// render returns the body of the problem and its content type.
+func (p *errorPages) render(r *http.Request, problem Problem) ([]byte, string) {
+	body := &bytes.Buffer{}
+
+	if p.html != nil && acceptsHTML(r) {
+		err := p.html.Execute(body, problem)
+		if err == nil {
+			return body.Bytes(), "text/html; charset=utf-8"
+		}
+
+		log.Printf("Failed to render html error page: %s", err)
+		body.Reset()
+	}
+
+	if p.json != nil {
+		err := p.json.Execute(body, problem)
+		if err == nil {
+			return body.Bytes(), "application/json"
+		}
+
+		log.Printf("Failed to render json error page: %s", err)
+	}
+
+	data, _ := json.Marshal(problem)
+	return data, "application/problem+json"
+}
+
+// writeError answers the request with an error generated by the balancer.
+func writeError(rw http.ResponseWriter, r *http.Request, status int, reason, detail string) {
+	problem := Problem{
+		Type: "about:blank",
+		Title: http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Reason: reason,
+		RequestID: requestID(r),
+	}
+
+	body, contentType := activeErrorPages.Load().render(r, problem)
+
+	header := rw.Header()
+	header.Set("content-type", contentType)
+	header.Set("content-length", strconv.Itoa(len(body)))
+	header.Set("cache-control", "no-store")
+
+	if status == http.StatusServiceUnavailable {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+
+	if *traceEnabled {
+		header.Set("lb-error", reason)
+	}
+
+	rw.WriteHeader(status)
+	_, _ = rw.Write(body)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withTrace(t *testing.T) {
+	withFlag(t, traceEnabled, true)
+}
+
+func TestEmptyPoolError(t *testing.T) {
+	withPool(t)
+	withTrace(t)
+
+	rw := httptest.NewRecorder()
+	httpBalancer.Load().ServeHTTP(rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+	assert.Equal(t, ReasonNoBackend, rw.Header().Get("lb-error"))
+	assert.Equal(t, "application/problem+json", rw.Header().Get("content-type"))
+
+	var problem Problem
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &problem))
+	assert.Equal(t, http.StatusServiceUnavailable, problem.Status)
+	assert.Equal(t, ReasonNoBackend, problem.Reason)
+	assert.NotEmpty(t, problem.RequestID)
+}
+
+func TestBadUpstreamError(t *testing.T) {
+	withTrace(t)
+
+	// a closed listener leaves a port nobody accepts connections on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	rw := httptest.NewRecorder()
+	forward(address, rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, ReasonUpstreamError, rw.Header().Get("lb-error"))
+	assert.Empty(t, rw.Header().Get("Retry-After"))
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	htmlPath := filepath.Join(dir, "error.html")
+	jsonPath := filepath.Join(dir, "error.json")
+
+	assert.Nil(t, os.WriteFile(htmlPath, []byte(`<h1>{{.Status}} {{.Title}}</h1><p>{{.Detail}}</p>`), 0o644))
+	assert.Nil(t, os.WriteFile(jsonPath, []byte(`{"error": {{json .Reason}}, "detail": {{json .Detail}}}`), 0o644))
+
+	assert.Nil(t, setErrorPages(ErrorPagesConfig{HTML: htmlPath, JSON: jsonPath}))
+	t.Cleanup(func() { _ = setErrorPages(ErrorPagesConfig{}) })
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	rw := httptest.NewRecorder()
+	writeError(rw, r, http.StatusBadGateway, ReasonUpstreamError, "<backend>")
+
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("content-type"))
+	assert.Equal(t, "<h1>502 Bad Gateway</h1><p>&lt;backend&gt;</p>", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	writeError(rw, httptest.NewRequest("GET", "/", nil), http.StatusGatewayTimeout, ReasonUpstreamTimeout, `"quoted" \ <detail>`)
+
+	assert.Equal(t, "application/json", rw.Header().Get("content-type"))
+	assert.JSONEq(t, `{"error": "upstream-timeout", "detail": "\"quoted\" \\ <detail>"}`, rw.Body.String())
+
+	assert.NotNil(t, setErrorPages(ErrorPagesConfig{HTML: filepath.Join(dir, "missing.html")}))
+}
+
+func TestSetRequestID(t *testing.T) {
+	for id, kept := range map[string]bool{
+		"5f2b-41.a:7_c": true,
+		"": false,
+		`"}, "injected": {"`: false,
+		strings.Repeat("a", 129): false,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(requestIDHeader, id)
+		setRequestID(r)
+
+		if kept {
+			assert.Equal(t, id, requestID(r))
+			continue
+		}
+
+		assert.NotEqual(t, id, requestID(r), "request ID %#v is replaced", id)
+		assert.True(t, validRequestID(requestID(r)))
+	}
+}
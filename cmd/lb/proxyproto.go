@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	proxyProtocol = flag.Bool("proxy-protocol", false, "whether to accept PROXY protocol v1/v2 headers from trusted sources")
+	proxyTrustedCIDRs = flag.String("proxy-trusted-cidrs", "", "comma separated CIDRs allowed to send PROXY protocol headers, required with -proxy-protocol")
+	proxyHeaderTimeout = flag.Duration("proxy-header-timeout", 5 * time.Second, "time to receive a PROXY protocol header")
+	backendProxyProtocol = flag.String("backend-proxy-protocol", "", "PROXY protocol version to send to backends: v1, v2 or empty to disable")
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1Prefix = "PROXY "
+	proxyV1MaxLength = 107
+	proxyV2HeaderLength = 16
+
+	proxyV2CommandLocal = 0x0
+	proxyV2CommandProxy = 0x1
+
+	proxyV2FamilyTCP4 = 0x11
+	proxyV2FamilyTCP6 = 0x21
+)
+
+var errProxyHeader = errors.New("malformed PROXY protocol header")
+
+// readProxyHeader consumes a PROXY protocol header if the connection starts
+// with one and returns the client address it carries. A nil address means
+// the connection has no header or the header does not describe a client.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		prefix, err := reader.Peek(len(proxyV1Prefix))
+		if err != nil || string(prefix) != proxyV1Prefix {
+			return nil, nil
+		}
+		return readProxyV1(reader)
+	case proxyV2Signature[0]:
+		signature, err := reader.Peek(len(proxyV2Signature))
+		if err != nil || !bytes.Equal(signature, proxyV2Signature) {
+			return nil, nil
+		}
+		return readProxyV2(reader)
+	}
+
+	return nil, nil
+}
+
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errProxyHeader
+		}
+
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	versionCommand := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if versionCommand >> 4 != 2 {
+		return nil, errProxyHeader
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	if versionCommand & 0xf == proxyV2CommandLocal {
+		return nil, nil
+	}
+
+	if versionCommand & 0xf != proxyV2CommandProxy {
+		return nil, errProxyHeader
+	}
+
+	switch family {
+	case proxyV2FamilyTCP4:
+		if len(payload) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP: net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case proxyV2FamilyTCP6:
+		if len(payload) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP: net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// writeProxyHeader sends a PROXY protocol header announcing a connection
+// from src to dst. Without a TCP source the header carries no addresses.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+
+	known := srcOk && dstOk && (srcTCP.IP.To4() == nil) == (dstTCP.IP.To4() == nil)
+
+	switch version {
+	case "v1":
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+
+		family := "TCP6"
+		if srcTCP.IP.To4() != nil {
+			family = "TCP4"
+		}
+
+		_, err := fmt.Fprintf(
+			w,
+			"PROXY %s %s %s %d %d\r\n",
+			family,
+			srcTCP.IP.String(),
+			dstTCP.IP.String(),
+			srcTCP.Port,
+			dstTCP.Port,
+		)
+		return err
+	case "v2":
+		header := append([]byte{}, proxyV2Signature...)
+
+		if !known {
+			header = append(header, 0x20 | proxyV2CommandLocal, 0, 0, 0)
+			_, err := w.Write(header)
+			return err
+		}
+
+		family := byte(proxyV2FamilyTCP6)
+		srcIP, dstIP := srcTCP.IP.To16(), dstTCP.IP.To16()
+
+		if srcTCP.IP.To4() != nil {
+			family = proxyV2FamilyTCP4
+			srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4()
+		}
+
+		payload := append(append([]byte{}, srcIP...), dstIP...)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(srcTCP.Port))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(dstTCP.Port))
+
+		header = append(header, 0x20 | proxyV2CommandProxy, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+		header = append(header, payload...)
+
+		_, err := w.Write(header)
+		return err
+	}
+
+	return fmt.Errorf("unsupported PROXY protocol version %#v", version)
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+
+		if cidr == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		ipNets = append(ipNets, ipNet)
+	}
+
+	return ipNets, nil
+}
+
+// trusts reports whether the source may set the client address. Without
+// trusted CIDRs nobody may, as any client could spoof it otherwise.
+func (l *proxyListener) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil || !l.trusts(conn.RemoteAddr()) {
+		return conn, err
+	}
+
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the PROXY protocol header lazily, on the first use, so
+// a slow client does not block the accepting goroutine.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once sync.Once
+	remote net.Addr
+	err error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(*proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY protocol header from %v: %w", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func proxyProtocolListener(trusted []*net.IPNet) func(net.Listener) net.Listener {
+	return func(listener net.Listener) net.Listener {
+		return &proxyListener{Listener: listener, trusted: trusted}
+	}
+}
+
+type clientAddrKey struct{}
+
+// withClientAddr remembers the client address for the PROXY protocol header
+// sent on the backend connection.
+func withClientAddr(ctx context.Context, remoteAddr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, remoteAddr)
+}
+
+func clientAddr(ctx context.Context) net.Addr {
+	remoteAddr, _ := ctx.Value(clientAddrKey{}).(string)
+
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func proxyProtocolDialer(dial dialFunc, version string) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		// the destination is the balancer address the client connected to
+		dst, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok {
+			dst = conn.RemoteAddr()
+		}
+
+		if err := writeProxyHeader(conn, version, clientAddr(ctx), dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
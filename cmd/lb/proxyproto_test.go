@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	addrs := []struct{ src, dst string }{
+		{"192.0.2.10:51234", "198.51.100.1:8090"},
+		{"[2001:db8::10]:51234", "[2001:db8::1]:8090"},
+	}
+
+	for _, version := range []string{"v1", "v2"} {
+		for _, pair := range addrs {
+			t.Run(version + " " + pair.src, func(t *testing.T) {
+				src, _ := net.ResolveTCPAddr("tcp", pair.src)
+				dst, _ := net.ResolveTCPAddr("tcp", pair.dst)
+
+				buffer := &bytes.Buffer{}
+				assert.Nil(t, writeProxyHeader(buffer, version, src, dst))
+				buffer.WriteString("GET / HTTP/1.1\r\n")
+
+				reader := bufio.NewReader(buffer)
+				remote, err := readProxyHeader(reader)
+
+				assert.Nil(t, err)
+				assert.Equal(t, src.String(), remote.String())
+
+				rest, _ := io.ReadAll(reader)
+				assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest), "header is consumed")
+			})
+		}
+	}
+}
+
+func TestProxyHeaderWithoutClient(t *testing.T) {
+	for _, version := range []string{"v1", "v2"} {
+		buffer := &bytes.Buffer{}
+		assert.Nil(t, writeProxyHeader(buffer, version, nil, nil))
+
+		remote, err := readProxyHeader(bufio.NewReader(buffer))
+		assert.Nil(t, err, version)
+		assert.Nil(t, remote, version)
+	}
+}
+
+func TestProxyHeaderAbsent(t *testing.T) {
+	for _, request := range []string{"GET / HTTP/1.1\r\n", "POST / HTTP/1.1\r\n", "PUT / HTTP/1.1\r\n"} {
+		reader := bufio.NewReader(strings.NewReader(request))
+
+		remote, err := readProxyHeader(reader)
+		assert.Nil(t, err)
+		assert.Nil(t, remote)
+
+		rest, _ := io.ReadAll(reader)
+		assert.Equal(t, request, string(rest), "request is untouched")
+	}
+}
+
+func TestProxyHeaderMalformed(t *testing.T) {
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.10\r\n",
+		"PROXY TCP4 nonsense 192.0.2.1 1 2\r\n",
+		"PROXY " + strings.Repeat("1", proxyV1MaxLength) + "\r\n",
+	} {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(header)))
+		assert.NotNil(t, err, header)
+	}
+}
+
+func serveProxied(t *testing.T, trusted string) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	ipNets, err := parseCIDRs(trusted)
+	assert.Nil(t, err)
+
+	remotes := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		remotes <- r.RemoteAddr
+	})}
+
+	go server.Serve(proxyProtocolListener(ipNets)(listener))
+	t.Cleanup(func() { server.Close() })
+
+	return listener.Addr().String(), remotes
+}
+
+func sendProxied(t *testing.T, address string) {
+	conn, err := net.Dial("tcp", address)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	src, _ := net.ResolveTCPAddr("tcp", "203.0.113.7:40000")
+	assert.Nil(t, writeProxyHeader(conn, "v2", src, conn.RemoteAddr()))
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: balancer\r\n\r\n")
+	_, _ = http.ReadResponse(bufio.NewReader(conn), nil)
+}
+
+func TestProxyListener(t *testing.T) {
+	address, remotes := serveProxied(t, "127.0.0.0/8")
+	sendProxied(t, address)
+
+	assert.Equal(t, "203.0.113.7:40000", <-remotes, "trusted source sets client address")
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	for _, trusted := range []string{"10.0.0.0/8", ""} {
+		address, remotes := serveProxied(t, trusted)
+		sendProxied(t, address)
+
+		select {
+		case remote := <-remotes:
+			t.Errorf("header from source outside of %#v accepted: %s", trusted, remote)
+		default:
+		}
+	}
+}
+
+func TestProxyProtocolDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	received := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		remote, _ := readProxyHeader(bufio.NewReader(conn))
+		received <- remote
+	}()
+
+	dialer := &net.Dialer{}
+	dial := proxyProtocolDialer(dialer.DialContext, "v1")
+
+	ctx := withClientAddr(context.Background(), "198.51.100.20:3000")
+	conn, err := dial(ctx, "tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "198.51.100.20:3000", (<-received).String())
+}
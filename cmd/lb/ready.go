@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+)
+
+var (
+	minHealthy = flag.Int("min-healthy", 1, "amount of healthy backends required before the balancer accepts traffic")
+	minHealthyTimeout = flag.Duration("min-healthy-timeout", 30 * time.Second, "how long to wait for -min-healthy backends before listening anyway, 0 waits forever")
+)
+
+// serving is set once the frontend listens and cleared on shutdown.
+var serving atomic.Bool
+
+// sweepBackends checks every backend concurrently, so the pool only holds
+// the live ones before the first client arrives. It returns the amount of
+// healthy backends.
+func sweepBackends(checkHealth balancer.HealthChecker) int {
+	wg := sync.WaitGroup{}
+
+	for _, backend := range Backends {
+		if backend.State() == StateMaintenance {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start := time.Now()
+			alive := checkHealth(backend.Address)
+			backend.metrics.recordCheck(start, time.Since(start), alive)
+
+			if !alive && backend.Transition(StateUnhealthy, StateHealthy) {
+				backend.metrics.lastDied.Store(start.UnixNano())
+				log.Printf("%v is down at startup\n", backend.Address)
+			}
+
+			if alive && backend.Transition(StateHealthy, StateUnhealthy) {
+				backend.metrics.lastResurrected.Store(start.UnixNano())
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	healthy := len(ServersPool())
+	log.Printf("Startup health sweep: %d of %d backends healthy", healthy, len(Backends))
+
+	return healthy
+}
+
+// waitHealthy blocks until the pool holds enough backends to open the
+// listener or the timeout passes, a zero timeout never passes. The health
+// monitor has to be running to refill the pool. It reports whether enough
+// backends became healthy.
+func waitHealthy(minimum int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for len(ServersPool()) < minimum {
+		if timeout > 0 && !time.Now().Before(deadline) {
+			log.Printf("Gave up waiting for %d healthy backends after %s, %d available", minimum, timeout, len(ServersPool()))
+			return false
+		}
+
+		log.Printf("Waiting for %d healthy backends, %d available", minimum, len(ServersPool()))
+		time.Sleep(CheckServerHealthInterval)
+	}
+
+	return true
+}
+
+// ready reports whether the balancer accepts traffic and has enough healthy
+// backends to serve it.
+func ready() (bool, string) {
+	if !serving.Load() {
+		return false, "not serving"
+	}
+
+	if healthy := len(ServersPool()); healthy < *minHealthy {
+		return false, fmt.Sprintf("%d of %d required backends healthy", healthy, *minHealthy)
+	}
+
+	return true, "ready"
+}
+
+func serveReady(rw http.ResponseWriter, r *http.Request) {
+	isReady, reason := ready()
+
+	status := http.StatusOK
+	if !isReady {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeProbe(rw, status, reason)
+}
+
+// serveHealthz answers as long as the process is able to handle requests.
+func serveHealthz(rw http.ResponseWriter, r *http.Request) {
+	writeProbe(rw, http.StatusOK, "ok")
+}
+
+func writeProbe(rw http.ResponseWriter, status int, reason string) {
+	rw.Header().Set("content-type", "text/plain; charset=utf-8")
+	rw.Header().Set("cache-control", "no-store")
+	rw.WriteHeader(status)
+	_, _ = fmt.Fprintln(rw, reason)
+}
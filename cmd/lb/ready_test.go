@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweepBackends(t *testing.T) {
+	withPool(t, "up1:8080", "up2:8080", "down:8080")
+
+	check := func(server string) bool {
+		time.Sleep(100 * time.Millisecond)
+		return server != "down:8080"
+	}
+
+	start := time.Now()
+	healthy := sweepBackends(check)
+
+	assert.Less(t, time.Since(start), 250 * time.Millisecond, "backends are checked concurrently")
+	assert.Equal(t, 2, healthy)
+	assert.ElementsMatch(t, []string{"up1:8080", "up2:8080"}, ServersPool())
+	assert.Equal(t, StateUnhealthy, Backends["down:8080"].State())
+}
+
+func TestSweepSkipsMaintenance(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+	Backends["b:8080"].Transition(StateMaintenance, StateHealthy)
+
+	checked := []string{}
+	sweepBackends(func(server string) bool {
+		checked = append(checked, server)
+		return true
+	})
+
+	assert.Equal(t, []string{"a:8080"}, checked)
+	assert.Equal(t, StateMaintenance, Backends["b:8080"].State())
+}
+
+func probe(handler http.HandlerFunc) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", "/", nil))
+
+	return rw
+}
+
+func TestReadiness(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+
+	savedMinHealthy := *minHealthy
+	t.Cleanup(func() {
+		*minHealthy = savedMinHealthy
+		serving.Store(false)
+	})
+
+	*minHealthy = 2
+
+	assert.Equal(t, http.StatusOK, probe(serveHealthz).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, probe(serveReady).Code, "not ready before the listener opens")
+
+	serving.Store(true)
+	assert.Equal(t, http.StatusOK, probe(serveReady).Code)
+
+	Backends["a:8080"].Transition(StateUnhealthy, StateHealthy)
+	rw := probe(serveReady)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "1 of 2 required backends healthy\n", rw.Body.String())
+
+	serving.Store(false)
+	assert.Equal(t, http.StatusOK, probe(serveHealthz).Code, "alive while shutting down")
+}
+
+func TestWaitHealthyTimeout(t *testing.T) {
+	withPool(t, "a:8080")
+	withFlag(t, &CheckServerHealthInterval, time.Millisecond)
+
+	assert.True(t, waitHealthy(1, 0))
+
+	start := time.Now()
+	assert.False(t, waitHealthy(2, 20 * time.Millisecond), "missing backends do not block startup forever")
+	assert.Less(t, time.Since(start), time.Second)
+}
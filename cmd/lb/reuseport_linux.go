@@ -0,0 +1,28 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import (
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not export.
+const soReusePort = 0xf
+
+const reusePortSupported = true
+
+// reusePort lets several listeners share the port, so the kernel spreads
+// incoming connections between their accepting goroutines.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// RouteConfig applies settings to the requests whose path starts with the
+// prefix. The route with the longest matching prefix is used.
+type RouteConfig struct {
+	Name string `json:"name,omitempty"`
+	PathPrefix string `json:"path_prefix"`
+	Access AccessConfig `json:"access"`
+	Timeouts TimeoutConfig `json:"timeouts"`
+}
+
+type route struct {
+	config RouteConfig
+	access *accessList
+}
+
+type routeTable struct {
+	access *accessList
+	// routes are sorted from the longest prefix
+	routes []*route
+}
+
+var activeRoutes atomic.Pointer[routeTable]
+
+func init() {
+	activeRoutes.Store(&routeTable{})
+}
+
+func compileRoutes(access AccessConfig, routes []RouteConfig) (*routeTable, error) {
+	table := &routeTable{}
+
+	globalAccess, err := compileAccess(access)
+	if err != nil {
+		return nil, fmt.Errorf("access: %w", err)
+	}
+	table.access = globalAccess
+
+	prefixes := map[string]bool{}
+
+	for _, config := range routes {
+		if config.Name == "" {
+			config.Name = config.PathPrefix
+		}
+
+		if prefixes[config.PathPrefix] {
+			return nil, fmt.Errorf("duplicate route for %#v", config.PathPrefix)
+		}
+		prefixes[config.PathPrefix] = true
+
+		if err := config.Timeouts.Validate(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", config.Name, err)
+		}
+
+		routeAccess, err := compileAccess(config.Access)
+		if err != nil {
+			return nil, fmt.Errorf("route %s access: %w", config.Name, err)
+		}
+
+		table.routes = append(table.routes, &route{config: config, access: routeAccess})
+	}
+
+	slices.SortStableFunc(table.routes, func(a, b *route) int {
+		return len(b.config.PathPrefix) - len(a.config.PathPrefix)
+	})
+
+	return table, nil
+}
+
+func setRoutes(access AccessConfig, routes []RouteConfig) error {
+	table, err := compileRoutes(access, routes)
+	if err != nil {
+		return err
+	}
+
+	activeRoutes.Store(table)
+
+	return nil
+}
+
+func (t *routeTable) match(r *http.Request) *route {
+	for _, route := range t.routes {
+		if strings.HasPrefix(r.URL.Path, route.config.PathPrefix) {
+			return route
+		}
+	}
+
+	return nil
+}
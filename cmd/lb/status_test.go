@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateCounter(t *testing.T) {
+	counter := &rateCounter{}
+	now := time.Unix(1000, 0)
+
+	for sec := int64(0); sec < 10; sec++ {
+		for i := 0; i < 5; i++ {
+			counter.Add(now.Add(time.Duration(sec) * time.Second))
+		}
+	}
+
+	later := now.Add(10 * time.Second)
+	assert.Equal(t, 5.0, counter.Rate(later, 10))
+	assert.Equal(t, 2.5, counter.Rate(later.Add(5 * time.Second), 10), "old seconds leave the window")
+
+	// the same bucket a minute later starts from scratch
+	counter.Add(now.Add(rateWindowSec * time.Second))
+	assert.Equal(t, int64(1), counter.buckets[1000 % rateWindowSec].Load())
+}
+
+func TestStatusJSON(t *testing.T) {
+	withPool(t, "a:8080", "b:8080")
+
+	Backends["a:8080"].metrics.recordCheck(time.Now(), 3 * time.Millisecond, true)
+	Backends["b:8080"].Transition(StateUnhealthy, StateHealthy)
+	Backends["b:8080"].metrics.lastDied.Store(time.Now().UnixNano())
+
+	rec := httptest.NewRecorder()
+	adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status.json", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var status statusInfo
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&status))
+
+	assert.Equal(t, 1, status.PoolSize)
+	assert.Len(t, status.Backends, 2)
+
+	a, b := status.Backends[0], status.Backends[1]
+
+	assert.Equal(t, StateHealthy, a.State)
+	assert.NotNil(t, a.LastCheck)
+	assert.True(t, a.LastCheckOK)
+	assert.Equal(t, 3.0, a.LastCheckLatencyMs)
+	assert.Nil(t, a.LastDied)
+
+	assert.Equal(t, StateUnhealthy, b.State)
+	assert.NotNil(t, b.LastDied)
+}
+
+func TestStatusPage(t *testing.T) {
+	rec := httptest.NewRecorder()
+	adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "status.json", "page refreshes from the JSON endpoint")
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/httptools"
+)
+
+var (
+	mode = flag.String("mode", "http", "balancing mode: http or tcp")
+	healthCheck = flag.String("health-check", "", "health check kind: http or tcp, defaults to the balancing mode")
+	tcpIdleTimeout = flag.Duration("tcp-idle-timeout", 5 * time.Minute, "time a proxied TCP connection may stay without traffic")
+	tcpListeners = flag.Int("tcp-listeners", runtime.NumCPU(), "amount of listeners sharing the port in tcp mode")
+)
+
+// tcpCopyChunk bounds a single splice between connections, so the idle
+// deadline is refreshed while data keeps flowing.
+const tcpCopyChunk = 1 << 20
+
+func tcpHealth(dst string) bool {
+	conn, err := net.DialTimeout("tcp", dst, *dialTimeout)
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+type tcpServer struct {
+	port int
+	listenersAmount int
+	wrappers []httptools.ListenerWrapper
+
+	listeners []net.Listener
+	closing atomic.Bool
+
+	connsM sync.Mutex
+	conns map[net.Conn]struct{}
+	connsWG sync.WaitGroup
+}
+
+func createTCPServer(port int, listenersAmount int, wrappers ...httptools.ListenerWrapper) *tcpServer {
+	if !reusePortSupported || listenersAmount < 1 {
+		listenersAmount = 1
+	}
+
+	return &tcpServer{
+		port: port,
+		listenersAmount: listenersAmount,
+		wrappers: wrappers,
+		conns: map[net.Conn]struct{}{},
+	}
+}
+
+func (s *tcpServer) Start() {
+	log.Printf("Staring the TCP server with %d listeners...", s.listenersAmount)
+
+	config := net.ListenConfig{Control: reusePort}
+
+	for i := 0; i < s.listenersAmount; i++ {
+		listener, err := config.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", s.port))
+		if err != nil {
+			log.Fatalf("TCP server failed to listen: %s. Finishing the process.", err)
+		}
+
+		// port 0 picks a random port for the first listener only
+		s.port = listener.Addr().(*net.TCPAddr).Port
+
+		for _, wrap := range s.wrappers {
+			listener = wrap(listener)
+		}
+
+		s.listeners = append(s.listeners, listener)
+
+		go s.accept(listener)
+	}
+}
+
+func (s *tcpServer) Addr() net.Addr {
+	return s.listeners[0].Addr()
+}
+
+// acceptBackoffMax bounds the pause after failed accepts, which keep failing
+// while the process is out of file descriptors.
+const acceptBackoffMax = time.Second
+
+func (s *tcpServer) accept(listener net.Listener) {
+	backoff := time.Duration(0)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			if s.closing.Load() {
+				return
+			}
+
+			backoff = min(max(2 * backoff, 5 * time.Millisecond), acceptBackoffMax)
+			log.Printf("Failed to accept connection: %s, retrying in %s", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+
+		backoff = 0
+
+		if !s.track(conn, true) {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer s.track(conn, false)
+			s.handle(conn)
+		}()
+	}
+}
+
+// track counts the connection in or out of the active ones. Connections
+// accepted once the server is closing are refused, as Shutdown may already
+// be waiting for the active ones.
+func (s *tcpServer) track(conn net.Conn, active bool) bool {
+	s.connsM.Lock()
+	defer s.connsM.Unlock()
+
+	if active {
+		if s.closing.Load() {
+			return false
+		}
+
+		s.conns[conn] = struct{}{}
+		s.connsWG.Add(1)
+		return true
+	}
+
+	delete(s.conns, conn)
+	s.connsWG.Done()
+	return true
+}
+
+func (s *tcpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	if !checkConnAccess(conn) {
+		return
+	}
+
+	remoteAddr := conn.RemoteAddr().String()
+	server := GetAvailableServer(remoteAddr)
+
+	if server == "" {
+		log.Printf("No backend for connection from %s", remoteAddr)
+		return
+	}
+
+	backend, known := Backends[server]
+
+	if known {
+		backend.startRequest()
+		defer backend.finishRequest()
+	}
+
+	dialer := &net.Dialer{Timeout: *dialTimeout, KeepAlive: *keepAlive}
+	upstream, err := dialer.Dial("tcp", server)
+
+	if known {
+		backend.metrics.recordRequest(err != nil)
+	}
+
+	if err != nil {
+		log.Printf("Failed to connect to %s: %s", server, err)
+		return
+	}
+	defer upstream.Close()
+
+	if *backendProxyProtocol != "" {
+		err := writeProxyHeader(upstream, *backendProxyProtocol, conn.RemoteAddr(), conn.LocalAddr())
+		if err != nil {
+			log.Printf("Failed to send PROXY protocol header to %s: %s", server, err)
+			return
+		}
+	}
+
+	log.Println("tcp", remoteAddr, "->", server)
+
+	pipe(conn, upstream, *tcpIdleTimeout)
+}
+
+type activity struct {
+	last atomic.Int64
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *activity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// pipe copies bytes in both directions until both sides finish or the
+// connection stays without traffic in either direction for idleTimeout.
+func pipe(client, upstream net.Conn, idleTimeout time.Duration) {
+	seen := &activity{}
+	seen.touch()
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	transfer := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		err := copyIdle(dst, src, seen, idleTimeout)
+
+		if err != nil {
+			// unblock the opposite direction
+			client.Close()
+			upstream.Close()
+			return
+		}
+
+		if tcpConn, ok := dst.(interface{ CloseWrite() error }); ok {
+			tcpConn.CloseWrite()
+		}
+	}
+
+	go transfer(upstream, client)
+	go transfer(client, upstream)
+
+	wg.Wait()
+}
+
+func copyIdle(dst, src net.Conn, seen *activity, idleTimeout time.Duration) error {
+	for {
+		src.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		// io.Copy splices between TCP connections when src is a plain or
+		// limited TCP connection, so bytes do not pass through user space
+		n, err := io.Copy(dst, &io.LimitedReader{R: src, N: tcpCopyChunk})
+
+		if n > 0 {
+			seen.touch()
+		}
+
+		if err == nil && n < tcpCopyChunk {
+			return nil
+		}
+
+		if errors.Is(err, os.ErrDeadlineExceeded) && seen.idleFor() < idleTimeout {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Shutdown stops accepting connections and waits for the proxied ones to
+// finish until ctx is done, closing the rest afterwards.
+func (s *tcpServer) Shutdown(ctx context.Context) error {
+	s.connsM.Lock()
+	s.closing.Store(true)
+	s.connsM.Unlock()
+
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("TCP server drained")
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.connsM.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsM.Unlock()
+
+	return fmt.Errorf("TCP server shutdown: %w", ctx.Err())
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func echoBackend(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func startTCP(t *testing.T, listeners int) *tcpServer {
+	server := createTCPServer(0, listeners)
+	server.Start()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+
+	return server
+}
+
+func TestTCPProxy(t *testing.T) {
+	backend := echoBackend(t)
+	withPool(t, backend)
+
+	server := startTCP(t, 4)
+
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.Nil(t, err)
+
+		_, err = conn.Write([]byte("ping\n"))
+		assert.Nil(t, err)
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "ping\n", line, "bytes reach the backend and come back")
+
+		conn.Close()
+	}
+}
+
+func TestTCPProxyAccess(t *testing.T) {
+	backend := echoBackend(t)
+	withPool(t, backend)
+
+	assert.Nil(t, setRoutes(AccessConfig{Deny: []string{"127.0.0.0/8", "::1/128"}}, nil))
+	t.Cleanup(func() { _ = setRoutes(AccessConfig{}, nil) })
+
+	server := startTCP(t, 1)
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("ping\n"))
+
+	// the connection closes with the ping unread, so it may as well be reset
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NotNil(t, err, "a denied client is disconnected")
+	assert.Equal(t, "", line)
+}
+
+func TestTCPProxyHalfClose(t *testing.T) {
+	backend := echoBackend(t)
+	withPool(t, backend)
+
+	server := startTCP(t, 1)
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("request"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	response, err := io.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "request", string(response), "response after the client finished sending")
+}
+
+func TestTCPProxyIdleTimeout(t *testing.T) {
+	backend := echoBackend(t)
+	withPool(t, backend)
+
+	withFlag(t, tcpIdleTimeout, 50 * time.Millisecond)
+
+	server := startTCP(t, 1)
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+
+	assert.ErrorIs(t, err, io.EOF, "idle connection is closed by the balancer")
+}
+
+func TestTCPProxyNoBackend(t *testing.T) {
+	withPool(t)
+
+	server := startTCP(t, 1)
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTCPHealth(t *testing.T) {
+	backend := echoBackend(t)
+
+	assert.True(t, tcpHealth(backend))
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+
+	assert.False(t, tcpHealth(closed))
+}
+
+func TestTCPRefusesConnectionsWhileClosing(t *testing.T) {
+	server := createTCPServer(0, 1)
+	server.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, server.Shutdown(ctx))
+
+	client, late := net.Pipe()
+	defer client.Close()
+
+	assert.False(t, server.track(late, true), "a connection accepted during shutdown is not waited for")
+	assert.Empty(t, server.conns)
+}
+
+// failingListener fails every accept until it is closed.
+type failingListener struct {
+	net.Listener
+	accepts atomic.Int64
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	return nil, errors.New("too many open files")
+}
+
+func TestTCPAcceptBacksOff(t *testing.T) {
+	server := createTCPServer(0, 1)
+	listener := &failingListener{}
+
+	done := make(chan struct{})
+	go func() {
+		server.accept(listener)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	server.closing.Store(true)
+	<-done
+
+	assert.Less(t, listener.accepts.Load(), int64(10), "failing accepts are not retried in a busy loop")
+}
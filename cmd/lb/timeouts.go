@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	responseHeaderTimeout = flag.Duration("response-header-timeout", 0, "time to wait for the backend response headers once the request is sent, 0 leaves it to the total timeout")
+	idleTimeout = flag.Duration("idle-timeout", 0, "time the backend may pause while sending a response body, 0 disables it")
+)
+
+// requestTimeoutHeader lets clients shorten the total timeout of a request,
+// either in seconds or as a duration like "1500ms".
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// TimeoutConfig limits the phases of forwarding a request. Zero values keep
+// the timeout of the level above: the flags, the config and the route.
+// Connect and TLS handshake timeouts cannot be longer than the transport
+// ones set by -dial-timeout and -tls-handshake-timeout.
+type TimeoutConfig struct {
+	Connect Duration `json:"connect,omitempty"`
+	TLSHandshake Duration `json:"tls_handshake,omitempty"`
+	ResponseHeader Duration `json:"response_header,omitempty"`
+	Idle Duration `json:"idle,omitempty"`
+	Total Duration `json:"total,omitempty"`
+}
+
+func (c TimeoutConfig) Validate() error {
+	for _, d := range []Duration{c.Connect, c.TLSHandshake, c.ResponseHeader, c.Idle, c.Total} {
+		if d < 0 {
+			return fmt.Errorf("negative timeout %s", time.Duration(d))
+		}
+	}
+
+	return nil
+}
+
+// merge overrides the timeouts set in other.
+func (c TimeoutConfig) merge(other TimeoutConfig) TimeoutConfig {
+	for _, field := range []struct{ dst *Duration; src Duration }{
+		{&c.Connect, other.Connect},
+		{&c.TLSHandshake, other.TLSHandshake},
+		{&c.ResponseHeader, other.ResponseHeader},
+		{&c.Idle, other.Idle},
+		{&c.Total, other.Total},
+	} {
+		if field.src > 0 {
+			*field.dst = field.src
+		}
+	}
+
+	return c
+}
+
+func flagTimeouts() TimeoutConfig {
+	return TimeoutConfig{
+		Connect: Duration(*dialTimeout),
+		TLSHandshake: Duration(*tlsHandshakeTimeout),
+		ResponseHeader: Duration(*responseHeaderTimeout),
+		Idle: Duration(*idleTimeout),
+		Total: Duration(time.Duration(*timeoutSec) * time.Second),
+	}
+}
+
+func parseRequestTimeout(value string) (time.Duration, bool) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		// larger values, infinity and NaN would overflow into a negative
+		// duration or no deadline at all
+		if !(seconds > 0 && seconds < float64(math.MaxInt64 / int64(time.Second))) {
+			return 0, false
+		}
+
+		d := time.Duration(seconds * float64(time.Second))
+		return d, d > 0
+	}
+
+	d, err := time.ParseDuration(value)
+	return d, err == nil && d > 0
+}
+
+// requestTimeouts resolves the timeouts of the request.
+func requestTimeouts(r *http.Request) TimeoutConfig {
+	timeouts := flagTimeouts().merge(currentConfig.Load().Timeouts)
+
+	if route := activeRoutes.Load().match(r); route != nil {
+		timeouts = timeouts.merge(route.config.Timeouts)
+	}
+
+	if requested, ok := parseRequestTimeout(r.Header.Get(requestTimeoutHeader)); ok {
+		if timeouts.Total == 0 || Duration(requested) < timeouts.Total {
+			timeouts.Total = Duration(requested)
+		}
+	}
+
+	if remaining, ok := clientDeadline(r); ok && remaining > 0 {
+		if timeouts.Total == 0 || Duration(remaining) < timeouts.Total {
+			timeouts.Total = Duration(remaining)
+		}
+	}
+
+	return timeouts
+}
+
+// writeDeadlineSlack leaves the time to write the error of a request that
+// timed out after its total timeout.
+const writeDeadlineSlack = time.Second
+
+// extendWriteDeadline lets the response take as long as the total timeout
+// of the request, instead of the write timeout of the frontend server.
+func extendWriteDeadline(rw http.ResponseWriter, timeouts TimeoutConfig) {
+	deadline := time.Time{}
+	if timeouts.Total > 0 {
+		deadline = time.Now().Add(time.Duration(timeouts.Total) + writeDeadlineSlack)
+	}
+
+	// recorders of the tests do not support deadlines
+	_ = http.NewResponseController(rw).SetWriteDeadline(deadline)
+}
+
+// timeoutError is the cause of a request cancelled by one of its timeouts.
+type timeoutError struct {
+	phase string
+	after time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timeout after %s", e.phase, e.after)
+}
+
+func (e *timeoutError) Timeout() bool {
+	return true
+}
+
+// timedOut returns the timeout that failed the request, if any.
+func timedOut(ctx context.Context, err error) (*timeoutError, bool) {
+	var timeout *timeoutError
+
+	if errors.As(context.Cause(ctx), &timeout) {
+		return timeout, true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &timeoutError{phase: "transport"}, true
+	}
+
+	return nil, false
+}
+
+// phaseTimer cancels the request if a phase takes longer than its timeout.
+type phaseTimer struct {
+	m sync.Mutex
+	timer *time.Timer
+	cancel context.CancelCauseFunc
+}
+
+func (p *phaseTimer) start(phase string, d Duration) {
+	if d <= 0 {
+		return
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+
+	p.timer = time.AfterFunc(time.Duration(d), func() {
+		p.cancel(&timeoutError{phase: phase, after: time.Duration(d)})
+	})
+}
+
+func (p *phaseTimer) stop() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// withTimeouts bounds the request context by the total timeout and the
+// phase ones. The returned function releases the context.
+func withTimeouts(ctx context.Context, timeouts TimeoutConfig) (context.Context, *phaseTimer, func()) {
+	total := time.Duration(timeouts.Total)
+	cancelTotal := context.CancelFunc(func() {})
+
+	if total > 0 {
+		ctx, cancelTotal = context.WithTimeoutCause(ctx, total, &timeoutError{phase: "total", after: total})
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	phases := &phaseTimer{cancel: cancel}
+
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(string, string) { phases.start("connect", timeouts.Connect) },
+		ConnectDone: func(string, string, error) { phases.stop() },
+		TLSHandshakeStart: func() { phases.start("tls handshake", timeouts.TLSHandshake) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) { phases.stop() },
+		WroteRequest: func(httptrace.WroteRequestInfo) { phases.start("response header", timeouts.ResponseHeader) },
+		GotFirstResponseByte: phases.stop,
+	})
+
+	return ctx, phases, func() {
+		phases.stop()
+		cancel(nil)
+		cancelTotal()
+	}
+}
+
+// idleBody fails the response body once the backend pauses for too long.
+type idleBody struct {
+	io.ReadCloser
+	phases *phaseTimer
+	idle Duration
+}
+
+func withIdleTimeout(body io.ReadCloser, phases *phaseTimer, idle Duration) io.ReadCloser {
+	if idle <= 0 {
+		return body
+	}
+
+	phases.start("idle", idle)
+
+	return &idleBody{ReadCloser: body, phases: phases, idle: idle}
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if n > 0 {
+		b.phases.start("idle", b.idle)
+	}
+
+	return n, err
+}
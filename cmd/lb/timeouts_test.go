@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func slowBackend(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+		_, _ = rw.Write([]byte("slow"))
+	}))
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	withFlag(t, timeoutSec, 7)
+
+	assert.Nil(t, setRoutes(AccessConfig{}, []RouteConfig{
+		{PathPrefix: "/reports/", Timeouts: TimeoutConfig{Total: Duration(30 * time.Second), Idle: Duration(time.Second)}},
+	}))
+	t.Cleanup(func() { _ = setRoutes(AccessConfig{}, nil) })
+
+	timeouts := requestTimeouts(httptest.NewRequest("GET", "/api/v1/some-data", nil))
+	assert.Equal(t, Duration(7 * time.Second), timeouts.Total, "the flag is read after parsing")
+	assert.Equal(t, Duration(*dialTimeout), timeouts.Connect)
+
+	timeouts = requestTimeouts(httptest.NewRequest("GET", "/reports/daily", nil))
+	assert.Equal(t, Duration(30 * time.Second), timeouts.Total)
+	assert.Equal(t, Duration(time.Second), timeouts.Idle)
+
+	req := httptest.NewRequest("GET", "/reports/daily", nil)
+	req.Header.Set(requestTimeoutHeader, "1.5")
+	assert.Equal(t, Duration(1500 * time.Millisecond), requestTimeouts(req).Total)
+
+	req.Header.Set(requestTimeoutHeader, "1m")
+	assert.Equal(t, Duration(30 * time.Second), requestTimeouts(req).Total, "the header only shortens the deadline")
+
+	req.Header.Set(requestTimeoutHeader, "soon")
+	assert.Equal(t, Duration(30 * time.Second), requestTimeouts(req).Total)
+
+	for _, value := range []string{"1e300", "inf", "NaN", "-1", "0.0000000001", "9999999999h"} {
+		req.Header.Set(requestTimeoutHeader, value)
+		assert.Equal(t, Duration(30 * time.Second), requestTimeouts(req).Total, "%s does not lift the deadline", value)
+	}
+}
+
+func TestForwardRequestTimeout(t *testing.T) {
+	backend := slowBackend(time.Second)
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	req.Header.Set(requestTimeoutHeader, "100ms")
+
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	err := forward(backend.Listener.Addr().String(), rw, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.Less(t, time.Since(start), 500 * time.Millisecond)
+	assert.ErrorContains(t, err, "total timeout")
+}
+
+func TestForwardResponseHeaderTimeout(t *testing.T) {
+	backend := slowBackend(time.Second)
+	defer backend.Close()
+
+	assert.Nil(t, setRoutes(AccessConfig{}, []RouteConfig{
+		{PathPrefix: "/api/", Timeouts: TimeoutConfig{ResponseHeader: Duration(50 * time.Millisecond)}},
+	}))
+	t.Cleanup(func() { _ = setRoutes(AccessConfig{}, nil) })
+
+	rw := httptest.NewRecorder()
+	err := forward(backend.Listener.Addr().String(), rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.ErrorContains(t, err, "response header timeout")
+}
+
+func TestForwardIdleTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("first"))
+		rw.(http.Flusher).Flush()
+
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		_, _ = rw.Write([]byte("second"))
+	}))
+	defer backend.Close()
+
+	withFlag(t, idleTimeout, 50 * time.Millisecond)
+
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	forward(backend.Listener.Addr().String(), rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+
+	assert.Less(t, time.Since(start), 500 * time.Millisecond)
+	assert.Equal(t, "first", rw.Body.String(), "the stalled body is cut")
+}
+
+func TestTotalTimeoutOutlastsWriteTimeout(t *testing.T) {
+	backend := slowBackend(300 * time.Millisecond)
+	defer backend.Close()
+
+	withPool(t, backend.Listener.Addr().String())
+
+	frontend := httptest.NewUnstartedServer(httpBalancer.Load())
+	frontend.Config.WriteTimeout = 100 * time.Millisecond
+	frontend.Start()
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL + "/api/v1/some-data")
+	if err != nil {
+		t.Fatalf("response is cut by the server write timeout: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "slow", string(body), "the response is not cut by the server write timeout")
+}
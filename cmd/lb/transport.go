@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxIdleConns = flag.Int("max-idle-conns", 100, "maximal amount of idle connections kept to each backend")
+	idleConnTimeout = flag.Duration("idle-conn-timeout", 90 * time.Second, "time an idle connection to a backend is kept open")
+	dialTimeout = flag.Duration("dial-timeout", 2 * time.Second, "time to establish a connection to a backend")
+	keepAlive = flag.Duration("keep-alive", 30 * time.Second, "interval of TCP keep-alive probes on backend connections")
+	tlsHandshakeTimeout = flag.Duration("tls-handshake-timeout", 5 * time.Second, "time to complete a TLS handshake with a backend")
+	prewarmConns = flag.Int("prewarm", 0, "amount of connections to open when a backend becomes healthy, a single one is used over HTTP/2")
+)
+
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: *dialTimeout,
+		KeepAlive: *keepAlive,
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: dialer.DialContext,
+		MaxIdleConns: *maxIdleConns,
+		MaxIdleConnsPerHost: *maxIdleConns,
+		IdleConnTimeout: *idleConnTimeout,
+		TLSHandshakeTimeout: *tlsHandshakeTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2: true,
+	}
+
+	if *backendProxyProtocol != "" {
+		// the PROXY protocol header describes a single client, so the
+		// connection can not be shared with requests of other clients
+		transport.DialContext = proxyProtocolDialer(dialer.DialContext, *backendProxyProtocol)
+		transport.DisableKeepAlives = true
+		transport.ForceAttemptHTTP2 = false
+	}
+
+	return transport
+}
+
+var (
+	sharedClientOnce sync.Once
+	sharedClient *http.Client
+)
+
+// clientFor returns the client owning the connection pool of the backend.
+// Addresses outside of the configured backends share a single pool.
+func clientFor(dst string) *http.Client {
+	if backend, known := Backends[dst]; known {
+		return backend.Client()
+	}
+
+	sharedClientOnce.Do(func() {
+		sharedClient = &http.Client{Transport: newTransport()}
+	})
+
+	return sharedClient
+}
+
+// backendTransport sends the requests over the connection pool of their
+// backend and tells the timeouts apart from other failures.
+type backendTransport struct{}
+
+func (backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dst := req.URL.Host
+	resp, err := clientFor(dst).Transport.RoundTrip(req)
+
+	if backend, known := Backends[dst]; known {
+		backend.metrics.recordRequest(err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	}
+
+	if err != nil {
+		if timeout, isTimeout := timedOut(req.Context(), err); isTimeout {
+			return nil, timeout
+		}
+	}
+
+	return resp, err
+}
+
+// Client lazily builds the backend transport so it picks up parsed flags.
+func (b *Backend) Client() *http.Client {
+	b.clientOnce.Do(func() {
+		b.client = &http.Client{Transport: newTransport()}
+	})
+
+	return b.client
+}
+
+// Prewarm opens amount connections to the backend concurrently and leaves
+// them idle in its pool. It returns the amount of connections opened, a
+// single one over HTTP/2 as it carries every request.
+func (b *Backend) Prewarm(amount int) int {
+	if amount <= 0 {
+		return 0
+	}
+
+	url := fmt.Sprintf("%s://%s/health", scheme(), b.Address)
+
+	var opened atomic.Int64
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				opened.Add(1)
+			}
+		},
+	})
+
+	responses := make(chan *http.Response, amount)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < amount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+			resp, err := b.Client().Do(req)
+			if err != nil {
+				return
+			}
+
+			responses <- resp
+		}()
+	}
+
+	// the bodies are read once every response arrived, otherwise a request
+	// could reuse the connection another one just released
+	wg.Wait()
+	close(responses)
+
+	for resp := range responses {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	log.Printf("%v prewarmed with %d connections\n", b.Address, opened.Load())
+	return int(opened.Load())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countingBackend() (*httptest.Server, *atomic.Int64) {
+	conns := &atomic.Int64{}
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		_, _ = rw.Write([]byte(`["1","2"]`))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+
+	return backend, conns
+}
+
+func TestBackendPrewarm(t *testing.T) {
+	backend, conns := countingBackend()
+	defer backend.Close()
+
+	// health checks wait for each other, so no connection is free to be
+	// reused before every one of them is opened
+	arrived := sync.WaitGroup{}
+	arrived.Add(3)
+	api := backend.Config.Handler
+	backend.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			arrived.Done()
+			arrived.Wait()
+		}
+
+		api.ServeHTTP(rw, r)
+	})
+
+	address := backend.Listener.Addr().String()
+	withPool(t, address)
+
+	assert.Equal(t, 3, Backends[address].Prewarm(3))
+	assert.Equal(t, int64(3), conns.Load(), "prewarmed connections are opened")
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		forward(address, rec, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	assert.Equal(t, int64(3), conns.Load(), "requests reuse prewarmed connections")
+}
+
+func BenchmarkForward(b *testing.B) {
+	backend, conns := countingBackend()
+	defer backend.Close()
+
+	address := backend.Listener.Addr().String()
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// 2 is the amount of idle connections per host kept by http.DefaultClient
+	for _, idle := range []int{2, 100} {
+		b.Run("max-idle-conns-" + fmt.Sprint(idle), func(b *testing.B) {
+			saved := *maxIdleConns
+			*maxIdleConns = idle
+			defer func() { *maxIdleConns = saved }()
+
+			withPool(b, address)
+			conns.Store(0)
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rec := httptest.NewRecorder()
+					forward(address, rec, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+				}
+			})
+
+			b.ReportMetric(float64(conns.Load()), "conns")
+		})
+	}
+}
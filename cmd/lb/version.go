@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+
+	"github.com/magicvegetable/architecture-lab-4/balancer"
+)
+
+// versionHeader forces the request to a version by name.
+const versionHeader = "lb-version"
+
+// VersionConfig groups backends running the same build. A version receives
+// its weight relative to the sum of the weights of all the versions.
+type VersionConfig struct {
+	Name string `json:"name"`
+	Weight float64 `json:"weight"`
+	Backends []string `json:"backends"`
+}
+
+// versionSplit assigns every client hash a version. The versions cover
+// consecutive ranges of the hash space in the configured order, so changing
+// a weight only moves the clients at the border of the ranges.
+type versionSplit struct {
+	versions []VersionConfig
+	total float64
+	versionOf map[string]string
+}
+
+var activeVersions atomic.Pointer[versionSplit]
+
+func init() {
+	activeVersions.Store(&versionSplit{})
+}
+
+func validateVersions(versions []VersionConfig) error {
+	names := map[string]bool{}
+	owners := map[string]string{}
+	total := 0.0
+
+	for _, version := range versions {
+		if version.Name == "" {
+			return fmt.Errorf("version without name")
+		}
+
+		if names[version.Name] {
+			return fmt.Errorf("duplicate version %s", version.Name)
+		}
+		names[version.Name] = true
+
+		if version.Weight < 0 {
+			return fmt.Errorf("version %s: negative weight", version.Name)
+		}
+		total += version.Weight
+
+		for _, address := range version.Backends {
+			if _, known := Backends[address]; !known {
+				return fmt.Errorf("version %s: unknown backend %s", version.Name, address)
+			}
+
+			if owner, owned := owners[address]; owned {
+				return fmt.Errorf("backend %s is in versions %s and %s", address, owner, version.Name)
+			}
+			owners[address] = version.Name
+		}
+	}
+
+	if len(versions) > 0 && total == 0 {
+		return fmt.Errorf("versions without weight")
+	}
+
+	return nil
+}
+
+// setVersions makes the version split active. Backends not listed in any
+// version get no traffic while versions are configured.
+func setVersions(versions []VersionConfig) {
+	split := &versionSplit{versions: versions, versionOf: map[string]string{}}
+
+	for _, version := range versions {
+		split.total += version.Weight
+
+		for _, address := range version.Backends {
+			split.versionOf[address] = version.Name
+		}
+	}
+
+	activeVersions.Store(split)
+
+	for _, version := range versions {
+		log.Printf("Version %s gets %.1f%% of clients", version.Name, version.Weight / split.total * 100)
+	}
+}
+
+// pick chooses the version of the client, or the forced one if it exists.
+// The version follows the client over all of its connections.
+func (s *versionSplit) pick(addr, forced string) int {
+	if forced != "" {
+		if i := slices.IndexFunc(s.versions, func(v VersionConfig) bool { return v.Name == forced }); i >= 0 {
+			return i
+		}
+	}
+
+	point := float64(balancer.Hash(clientHost(addr) + "#version") % 10000) / 10000 * s.total
+
+	for i, version := range s.versions {
+		if point < version.Weight {
+			return i
+		}
+
+		point -= version.Weight
+	}
+
+	return len(s.versions) - 1
+}
+
+// candidates narrows the pool down to the backends of the client version.
+// If none of them are healthy, the client falls over to the next version
+// with healthy backends.
+func (s *versionSplit) candidates(addr, forced string, pool []string) []string {
+	chosen := s.pick(addr, forced)
+
+	for offset := range s.versions {
+		version := s.versions[(chosen + offset) % len(s.versions)]
+
+		var healthy []string
+		for _, server := range pool {
+			if s.versionOf[server] == version.Name {
+				healthy = append(healthy, server)
+			}
+		}
+
+		if len(healthy) > 0 {
+			return healthy
+		}
+	}
+
+	return nil
+}
+
+type versionInfo struct {
+	Name string `json:"name"`
+	Weight float64 `json:"weight"`
+	Share float64 `json:"share"`
+	Backends []string `json:"backends"`
+	Healthy int `json:"healthy"`
+}
+
+func versionsInfo() []versionInfo {
+	split := activeVersions.Load()
+	infos := []versionInfo{}
+
+	for _, version := range split.versions {
+		healthy := 0
+		for _, server := range ServersPool() {
+			if split.versionOf[server] == version.Name {
+				healthy += 1
+			}
+		}
+
+		infos = append(infos, versionInfo{
+			Name: version.Name,
+			Weight: version.Weight,
+			Share: version.Weight / split.total,
+			Backends: version.Backends,
+			Healthy: healthy,
+		})
+	}
+
+	return infos
+}
+
+// traceVersion reports the version of the chosen backend in the response.
+func traceVersion(rw http.ResponseWriter, server string) {
+	if version := activeVersions.Load().versionOf[server]; version != "" {
+		rw.Header().Set(versionHeader, version)
+	}
+}
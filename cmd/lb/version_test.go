@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withVersions(t *testing.T, versions ...VersionConfig) {
+	assert.Nil(t, validateVersions(versions))
+	setVersions(versions)
+	t.Cleanup(func() { setVersions(nil) })
+}
+
+func canary(weight float64) []VersionConfig {
+	return []VersionConfig{
+		{Name: "canary", Weight: weight, Backends: []string{"c1:8080"}},
+		{Name: "stable", Weight: 100 - weight, Backends: []string{"s1:8080", "s2:8080"}},
+	}
+}
+
+func TestVersionSplit(t *testing.T) {
+	withPool(t, "c1:8080", "s1:8080", "s2:8080")
+	withVersions(t, canary(5)...)
+
+	clients := 10000
+	res := shares(clients)
+
+	assert.InDelta(t, 0.05, float64(res["c1:8080"]) / float64(clients), 0.01)
+	assert.InDelta(t, 0.95, float64(res["s1:8080"] + res["s2:8080"]) / float64(clients), 0.01)
+}
+
+func TestVersionSplitIsSticky(t *testing.T) {
+	withPool(t, "c1:8080", "s1:8080", "s2:8080")
+	withVersions(t, canary(5)...)
+
+	var onCanary []string
+	for i := 0; i < 10000; i++ {
+		addr := fmt.Sprintf("10.1.%d.%d:4000", i / 256, i % 256)
+
+		if GetAvailableServer(addr) == "c1:8080" {
+			onCanary = append(onCanary, addr)
+		}
+	}
+
+	setVersions(canary(10))
+
+	for _, addr := range onCanary {
+		assert.Equal(t, "c1:8080", GetAvailableServer(addr), "canary client %s moved after the weight grew", addr)
+	}
+}
+
+func TestVersionSplitIgnoresPorts(t *testing.T) {
+	withPool(t, "c1:8080", "s1:8080", "s2:8080")
+	withVersions(t, canary(5)...)
+
+	for i := 0; i < 1000; i++ {
+		onCanary := GetAvailableServer(fmt.Sprintf("10.2.%d.%d:4000", i / 256, i % 256)) == "c1:8080"
+
+		for port := 4001; port < 4010; port++ {
+			server := GetAvailableServer(fmt.Sprintf("10.2.%d.%d:%d", i / 256, i % 256, port))
+			assert.Equal(t, onCanary, server == "c1:8080", "client 10.2.%d.%d changed version on port %d", i / 256, i % 256, port)
+		}
+	}
+}
+
+func TestVersionOverride(t *testing.T) {
+	withPool(t, "c1:8080", "s1:8080", "s2:8080")
+	withVersions(t, canary(0)...)
+
+	assert.Equal(t, "c1:8080", availableServer("10.0.0.1:4000", "canary", ServersPool()))
+	assert.NotEqual(t, "c1:8080", availableServer("10.0.0.1:4000", "unknown", ServersPool()))
+}
+
+func TestVersionFallback(t *testing.T) {
+	withPool(t, "c1:8080", "s1:8080", "s2:8080")
+	withVersions(t, canary(100)...)
+
+	assert.Equal(t, "c1:8080", GetAvailableServer("10.0.0.1:4000"))
+
+	Backends["c1:8080"].Transition(StateUnhealthy, StateHealthy)
+
+	assert.Contains(t, []string{"s1:8080", "s2:8080"}, GetAvailableServer("10.0.0.1:4000"),
+		"clients fall over to another version without healthy backends")
+}
+
+func TestValidateVersions(t *testing.T) {
+	withPool(t, "c1:8080", "s1:8080")
+
+	assert.NotNil(t, validateVersions([]VersionConfig{{Name: "a", Weight: 1, Backends: []string{"x:8080"}}}))
+	assert.NotNil(t, validateVersions([]VersionConfig{{Name: "a", Weight: 1}, {Name: "a", Weight: 1}}))
+	assert.NotNil(t, validateVersions([]VersionConfig{{Name: "a"}}))
+	assert.NotNil(t, validateVersions([]VersionConfig{
+		{Name: "a", Weight: 1, Backends: []string{"c1:8080"}},
+		{Name: "b", Weight: 1, Backends: []string{"c1:8080"}},
+	}))
+}
+
+func TestVersionTrace(t *testing.T) {
+	backend := httpEchoBackend()
+	defer backend.Close()
+
+	address := backend.Listener.Addr().String()
+	withPool(t, address)
+	withVersions(t, VersionConfig{Name: "v2", Weight: 1, Backends: []string{address}})
+
+	withFlag(t, traceEnabled, true)
+
+	rw := httptest.NewRecorder()
+	httpBalancer.Load().ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "v2", rw.Header().Get(versionHeader))
+}
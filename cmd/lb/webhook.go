@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	webhookOutboxPath = flag.String("webhook-outbox", "", "file keeping undelivered webhook events across restarts, empty keeps them in memory")
+	webhookRetries = flag.Int("webhook-retries", 8, "attempts to deliver an event to a webhook before dropping it")
+	webhookTimeout = flag.Duration("webhook-timeout", 5 * time.Second, "time to deliver an event to a webhook")
+)
+
+var (
+	webhookBackoffBase = time.Second
+	webhookBackoffMax = time.Minute
+)
+
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Events limits the delivered event types, every event is sent if empty.
+	Events []string `json:"events,omitempty"`
+}
+
+type outboxEntry struct {
+	URL string `json:"url"`
+	Event Event `json:"event"`
+	Attempts int `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// webhookOutbox delivers events to webhooks in the background, retrying
+// failed deliveries with exponential backoff. Pending entries are persisted
+// to the outbox file, if any, by Run after every change, so publishing an
+// event never waits for the disk.
+type webhookOutbox struct {
+	m sync.Mutex
+	entries []outboxEntry
+	webhooks []WebhookConfig
+	changed bool
+
+	path string
+	retries int
+	client *http.Client
+	wake chan struct{}
+}
+
+func newWebhookOutbox(path string, retries int, timeout time.Duration) (*webhookOutbox, error) {
+	outbox := &webhookOutbox{
+		path: path,
+		retries: retries,
+		client: &http.Client{Timeout: timeout},
+		wake: make(chan struct{}, 1),
+	}
+
+	if path == "" {
+		return outbox, nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return outbox, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read webhook outbox: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &outbox.entries); err != nil {
+		return nil, fmt.Errorf("parse webhook outbox %s: %w", path, err)
+	}
+
+	if len(outbox.entries) > 0 {
+		log.Printf("Loaded %d undelivered webhook events", len(outbox.entries))
+	}
+
+	return outbox, nil
+}
+
+func (o *webhookOutbox) SetWebhooks(webhooks []WebhookConfig) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.webhooks = webhooks
+}
+
+// Enqueue queues the event for every webhook interested in it.
+func (o *webhookOutbox) Enqueue(event Event) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	queued := false
+
+	for _, webhook := range o.webhooks {
+		if len(webhook.Events) > 0 && !slices.Contains(webhook.Events, event.Type) {
+			continue
+		}
+
+		o.entries = append(o.entries, outboxEntry{URL: webhook.URL, Event: event, NextAttempt: event.Time})
+		queued = true
+	}
+
+	if !queued {
+		return
+	}
+
+	o.changed = true
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// LastEventID returns the highest ID of the pending events.
+func (o *webhookOutbox) LastEventID() uint64 {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	lastID := uint64(0)
+	for _, entry := range o.entries {
+		lastID = max(lastID, entry.Event.ID)
+	}
+
+	return lastID
+}
+
+// persist writes the entries to the outbox file if they changed. It is only
+// called from Run, so the file is written by a single goroutine.
+func (o *webhookOutbox) persist() {
+	o.m.Lock()
+
+	if o.path == "" || !o.changed {
+		o.m.Unlock()
+		return
+	}
+
+	data, err := json.Marshal(o.entries)
+	o.changed = false
+	o.m.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to encode webhook outbox: %s", err)
+		return
+	}
+
+	tmpPath := o.path + ".tmp"
+
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		log.Printf("Failed to write webhook outbox: %s", err)
+		return
+	}
+
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		log.Printf("Failed to write webhook outbox: %s", err)
+	}
+}
+
+func (o *webhookOutbox) deliver(ctx context.Context, entry outboxEntry) error {
+	body, err := json.Marshal(entry.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, entry.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func backoff(attempts int) time.Duration {
+	delay := webhookBackoffBase << min(attempts, 16)
+
+	return min(delay, webhookBackoffMax)
+}
+
+// next takes the first entry due for delivery, or reports when one will be.
+func (o *webhookOutbox) next(now time.Time) (outboxEntry, bool, time.Duration) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	wait := time.Duration(-1)
+
+	for i, entry := range o.entries {
+		if !entry.NextAttempt.After(now) {
+			o.entries = slices.Delete(o.entries, i, i + 1)
+			return entry, true, 0
+		}
+
+		if until := entry.NextAttempt.Sub(now); wait < 0 || until < wait {
+			wait = until
+		}
+	}
+
+	return outboxEntry{}, false, wait
+}
+
+func (o *webhookOutbox) finish(entry outboxEntry, err error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.changed = true
+
+	if err == nil {
+		return
+	}
+
+	entry.Attempts += 1
+
+	if entry.Attempts >= o.retries {
+		log.Printf("Dropping event %d for %s after %d attempts: %s", entry.Event.ID, entry.URL, entry.Attempts, err)
+		return
+	}
+
+	log.Printf("Failed to deliver event %d to %s: %s", entry.Event.ID, entry.URL, err)
+
+	entry.NextAttempt = time.Now().Add(backoff(entry.Attempts))
+	o.entries = append(o.entries, entry)
+}
+
+// requeue puts back an entry taken by next as it was.
+func (o *webhookOutbox) requeue(entry outboxEntry) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.entries = append(o.entries, entry)
+	o.changed = true
+}
+
+// Run delivers the queued events and persists them until ctx is done.
+func (o *webhookOutbox) Run(ctx context.Context) {
+	defer o.persist()
+
+	for {
+		o.persist()
+
+		entry, due, wait := o.next(time.Now())
+
+		if due {
+			err := o.deliver(ctx, entry)
+
+			// a delivery cancelled on shutdown is not an attempt, the entry
+			// is delivered again after the restart
+			if err != nil && ctx.Err() != nil {
+				o.requeue(entry)
+				return
+			}
+
+			o.finish(entry, err)
+			continue
+		}
+
+		var timer <-chan time.Time
+		if wait >= 0 {
+			timer = time.After(wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-timer:
+		}
+	}
+}
+
+// Start runs the outbox in the background. The returned function stops it
+// and waits until the pending entries are persisted.
+func (o *webhookOutbox) Start() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		o.Run(ctx)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/httptools"
+)
+
+// loadTracker measures the load the server reports on health checks. With
+// slots, at most that many requests are handled at once and the rest wait
+// in its queue.
+type loadTracker struct {
+	slots chan struct{}
+	queued atomic.Int64
+	inFlight atomic.Int64
+	// cpu holds the bits of the CPU share measured over the last interval
+	cpu atomic.Uint64
+}
+
+// newLoadTracker limits the requests handled at once to maxConcurrent, 0
+// for no limit.
+func newLoadTracker(maxConcurrent int) *loadTracker {
+	l := &loadTracker{}
+
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+
+	return l
+}
+
+// track queues the requests past the limit and counts the ones being
+// handled. Requests whose client gives up while queued are dropped.
+func (l *loadTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if l.slots != nil {
+			l.queued.Add(1)
+
+			select {
+			case l.slots <- struct{}{}:
+				l.queued.Add(-1)
+				defer func() { <-l.slots }()
+			case <-r.Context().Done():
+				l.queued.Add(-1)
+				http.Error(rw, "gave up in queue", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		l.inFlight.Add(1)
+		defer l.inFlight.Add(-1)
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// sample measures the CPU share of the process every interval.
+func (l *loadTracker) sample(interval time.Duration) {
+	lastCPU, ok := cpuTime()
+	if !ok {
+		return
+	}
+
+	last := time.Now()
+
+	for now := range time.Tick(interval) {
+		used, _ := cpuTime()
+		share := float64(used - lastCPU) / (float64(now.Sub(last)) * float64(runtime.NumCPU()))
+
+		l.cpu.Store(math.Float64bits(min(max(share, 0), 1)))
+		lastCPU, last = used, now
+	}
+}
+
+// Load suggests a weight dropping with the CPU use and the requests waiting
+// for a slot.
+func (l *loadTracker) Load() httptools.Load {
+	cpu := math.Float64frombits(l.cpu.Load())
+	queue := int(l.queued.Load())
+
+	return httptools.Load{
+		CPU: cpu,
+		Queue: queue,
+		InFlight: int(l.inFlight.Load()),
+		Weight: max(100 * (1 - cpu) / float64(1 + queue), 1),
+	}
+}
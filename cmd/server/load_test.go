@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magicvegetable/architecture-lab-4/httptools"
+)
+
+func TestLoadTracker(t *testing.T) {
+	tracker := newLoadTracker(2)
+
+	if load := tracker.Load(); load.Weight != 100 || load.InFlight != 0 {
+		t.Errorf("Unexpected idle load %s", load)
+	}
+
+	release := make(chan struct{})
+	entered := make(chan struct{}, 4)
+	handler := tracker.track(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	for i := 0; i < 4; i++ {
+		go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	<-entered
+	<-entered
+	for tracker.queued.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	load := tracker.Load()
+	if load.InFlight != 2 || load.Queue != 2 {
+		t.Errorf("Unexpected busy load %s", load)
+	}
+	if load.Weight > 100.0 / 3 {
+		t.Errorf("Weight %.1f does not drop with the queue", load.Weight)
+	}
+
+	close(release)
+	<-entered
+	<-entered
+
+	if load := tracker.Load(); load.Queue != 0 {
+		t.Errorf("Queue %d is not drained", load.Queue)
+	}
+}
+
+func TestLoadTrackerDropsAbandoned(t *testing.T) {
+	tracker := newLoadTracker(1)
+	tracker.slots <- struct{}{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rw := httptest.NewRecorder()
+	tracker.track(http.NotFoundHandler()).ServeHTTP(rw, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	if rw.Code != http.StatusServiceUnavailable || tracker.queued.Load() != 0 {
+		t.Errorf("Unexpected abandoned request %d, queue %d", rw.Code, tracker.queued.Load())
+	}
+}
+
+func TestHealthReportsLoad(t *testing.T) {
+	var shuttingDown atomic.Bool
+	handler := health(&shuttingDown, newLoadTracker(0))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/health", nil))
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "OK" {
+		t.Errorf("Unexpected plain health %d %s", rw.Code, rw.Body)
+	}
+	if load, err := httptools.ParseLoad(rw.Header().Get(httptools.LoadHeader)); err != nil || load.Weight != 100 {
+		t.Errorf("Unexpected load header %s (%v)", rw.Header().Get(httptools.LoadHeader), err)
+	}
+
+	shuttingDown.Store(true)
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("accept", "application/json")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	body := struct {
+		Status string `json:"status"`
+		httptools.Load
+	}{}
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode health: %s", err)
+	}
+
+	if rw.Code != http.StatusServiceUnavailable || body.Status != "SHUTTING DOWN" || body.Weight != 100 {
+		t.Errorf("Unexpected JSON health %d %+v", rw.Code, body)
+	}
+}
@@ -1,42 +1,98 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/magicvegetable/architecture-lab-4/httptools"
 	"github.com/magicvegetable/architecture-lab-4/signal"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var (
+	port = flag.Int("port", 8080, "server port")
+	drainDelay = flag.Duration("drain-delay", 3 * time.Second, "time to report failing health before shutdown so balancers stop sending requests")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 15 * time.Second, "time to wait for active requests on shutdown")
+	maxConcurrent = flag.Int("max-concurrent", 0, "amount of requests handled at once, the rest wait in a queue reported on health checks, 0 for no limit")
+	loadInterval = flag.Duration("load-interval", time.Second, "interval over which the CPU use reported on health checks is measured")
+)
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
-func main() {
-	h := new(http.ServeMux)
+// health reports the state of the server, along with its load in
+// httptools.LoadHeader and, for clients accepting JSON, in the body.
+func health(shuttingDown *atomic.Bool, load *loadTracker) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		status, code := "OK", http.StatusOK
+		if shuttingDown.Load() {
+			status, code = "SHUTTING DOWN", http.StatusServiceUnavailable
+		} else if failConfig := os.Getenv(confHealthFailure); failConfig == "true" {
+			status, code = "FAILURE", http.StatusInternalServerError
+		}
+
+		current := load.Load()
+		rw.Header().Set(httptools.LoadHeader, current.String())
 
-	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
-		rw.Header().Set("content-type", "text/plain")
-		if failConfig := os.Getenv(confHealthFailure); failConfig == "true" {
-			rw.WriteHeader(http.StatusInternalServerError)
-			_, _ = rw.Write([]byte("FAILURE"))
-		} else {
-			rw.WriteHeader(http.StatusOK)
-			_, _ = rw.Write([]byte("OK"))
+		if !strings.Contains(r.Header.Get("accept"), "application/json") {
+			rw.Header().Set("content-type", "text/plain")
+			rw.WriteHeader(code)
+			_, _ = rw.Write([]byte(status))
+			return
 		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(code)
+		_ = json.NewEncoder(rw).Encode(struct {
+			Status string `json:"status"`
+			httptools.Load
+		}{status, current})
 	})
+}
+
+// delay waits for d unless ctx is done first, as when the deadline of the
+// request passes. It reports whether the whole delay passed.
+func delay(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	h := new(http.ServeMux)
+
+	var shuttingDown atomic.Bool
+
+	load := newLoadTracker(*maxConcurrent)
+	go load.sample(*loadInterval)
+
+	h.Handle("/health", health(&shuttingDown, load))
 
 	report := make(Report)
 
-	h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
+	h.Handle("/api/v1/some-data", load.track(httptools.DeadlineHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		respDelayString := os.Getenv(confResponseDelaySec)
 		if delaySec, parseErr := strconv.Atoi(respDelayString); parseErr == nil && delaySec > 0 && delaySec < 300 {
-			time.Sleep(time.Duration(delaySec) * time.Second)
+			if !delay(r.Context(), time.Duration(delaySec) * time.Second) {
+				log.Printf("Dropped request past its deadline after %s", time.Duration(delaySec) * time.Second)
+				http.Error(rw, "deadline exceeded", http.StatusGatewayTimeout)
+				return
+			}
 		}
 
 		report.Process(r)
@@ -46,11 +102,22 @@ func main() {
 		_ = json.NewEncoder(rw).Encode([]string{
 			"1", "2",
 		})
-	})
+	}))))
 
 	h.Handle("/report", report)
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
 	signal.WaitForTerminationSignal()
+
+	shuttingDown.Store(true)
+	log.Printf("Reporting failing health for %s before shutdown", *drainDelay)
+	time.Sleep(*drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain connections: %s", err)
+	}
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDelayStopsAtDeadline(t *testing.T) {
+	if !delay(context.Background(), time.Millisecond) {
+		t.Errorf("Delay without deadline did not pass")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if delay(ctx, time.Minute) {
+		t.Errorf("Delay passed its deadline")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Delay took %s past a deadline of 20ms", elapsed)
+	}
+}
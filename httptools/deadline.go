@@ -0,0 +1,50 @@
+package httptools
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeadlineHeader carries the milliseconds left to answer a request, so the
+// servers behind a balancer stop working on requests nobody waits for.
+const DeadlineHeader = "X-Request-Deadline"
+
+func FormatDeadline(remaining time.Duration) string {
+	return strconv.FormatInt(max(remaining.Milliseconds(), 0), 10)
+}
+
+// ParseDeadline reads the value of DeadlineHeader. A deadline that already
+// passed is reported as a remaining time of 0.
+func ParseDeadline(value string) (time.Duration, bool) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(max(ms, 0)) * time.Millisecond, true
+}
+
+// DeadlineHandler cancels the context of the requests once their deadline
+// passes, and answers the ones arriving after it with 504 right away.
+func DeadlineHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		remaining, ok := ParseDeadline(r.Header.Get(DeadlineHeader))
+
+		if !ok {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		if remaining <= 0 {
+			http.Error(rw, "deadline exceeded", http.StatusGatewayTimeout)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), remaining)
+		defer cancel()
+
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,56 @@
+package httptools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDeadline(t *testing.T) {
+	remaining, ok := ParseDeadline(FormatDeadline(1500 * time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, 1500 * time.Millisecond, remaining)
+
+	remaining, ok = ParseDeadline("-20")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), remaining, "passed deadlines are not negative")
+
+	_, ok = ParseDeadline("1.5s")
+	assert.False(t, ok)
+
+	_, ok = ParseDeadline("")
+	assert.False(t, ok)
+}
+
+func TestDeadlineHandler(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+
+	handler := DeadlineHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	}))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.False(t, hasDeadline, "requests without the header are not bounded")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(DeadlineHeader, "2000")
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.True(t, hasDeadline)
+	assert.WithinDuration(t, time.Now().Add(2 * time.Second), deadline, 100 * time.Millisecond)
+
+	hasDeadline = false
+	req.Header.Set(DeadlineHeader, "0")
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.False(t, hasDeadline, "expired requests are not handled")
+}
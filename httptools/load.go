@@ -0,0 +1,61 @@
+package httptools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LoadHeader carries the load of a backend in its health check responses.
+const LoadHeader = "lb-load"
+
+// Load is what a backend reports about itself to the balancers checking
+// its health.
+type Load struct {
+	// CPU is the share of the machine used by the process, from 0 to 1.
+	CPU float64 `json:"cpu"`
+	// Queue is the amount of requests waiting for the backend to take them,
+	// always 0 for backends not limiting their concurrent requests.
+	Queue int `json:"queue"`
+	InFlight int `json:"in_flight"`
+	// Weight is the share of its traffic the backend asks for, from 0 to
+	// 100.
+	Weight float64 `json:"weight"`
+}
+
+// String formats the load as the value of LoadHeader.
+func (l Load) String() string {
+	return fmt.Sprintf("cpu=%.3f, queue=%d, in_flight=%d, weight=%.1f", l.CPU, l.Queue, l.InFlight, l.Weight)
+}
+
+// ParseLoad reads the value of LoadHeader. Unknown keys are skipped, so
+// backends can report more than the balancer understands.
+func ParseLoad(value string) (Load, error) {
+	load := Load{}
+
+	for _, field := range strings.Split(value, ",") {
+		key, raw, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			return Load{}, fmt.Errorf("malformed load field %#v", field)
+		}
+
+		var err error
+
+		switch key {
+		case "cpu":
+			load.CPU, err = strconv.ParseFloat(raw, 64)
+		case "queue":
+			load.Queue, err = strconv.Atoi(raw)
+		case "in_flight":
+			load.InFlight, err = strconv.Atoi(raw)
+		case "weight":
+			load.Weight, err = strconv.ParseFloat(raw, 64)
+		}
+
+		if err != nil {
+			return Load{}, fmt.Errorf("malformed load %s: %w", key, err)
+		}
+	}
+
+	return load, nil
+}
@@ -0,0 +1,25 @@
+package httptools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadHeader(t *testing.T) {
+	load := Load{CPU: 0.25, Queue: 2, InFlight: 10, Weight: 60}
+
+	parsed, err := ParseLoad(load.String())
+	assert.Nil(t, err)
+	assert.Equal(t, load, parsed)
+
+	parsed, err = ParseLoad("weight=40,future=1")
+	assert.Nil(t, err)
+	assert.Equal(t, Load{Weight: 40}, parsed)
+
+	_, err = ParseLoad("weight")
+	assert.NotNil(t, err)
+
+	_, err = ParseLoad("cpu=high")
+	assert.NotNil(t, err)
+}
@@ -1,36 +1,79 @@
 package httptools
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 type Server interface {
 	Start()
+	Shutdown(ctx context.Context) error
 }
 
+// ListenerWrapper decorates the listener accepting the server connections.
+type ListenerWrapper func(net.Listener) net.Listener
+
 type server struct {
 	httpServer *http.Server
+	wrappers []ListenerWrapper
 }
 
+// Start listens on the server port and serves it in the background, so
+// connections are accepted as soon as it returns.
 func (s server) Start() {
+	log.Println("Staring the HTTP server...")
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		log.Fatalf("HTTP server failed to listen: %s. Finishing the process.", err)
+	}
+
+	for _, wrap := range s.wrappers {
+		listener = wrap(listener)
+	}
+
 	go func() {
-		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		err := s.httpServer.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			log.Println("HTTP server stopped accepting connections")
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
-func CreateServer(port int, handler http.Handler) Server {
+// Shutdown stops accepting new connections and waits for the active requests
+// to complete until ctx is done.
+func (s server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("HTTP server shutdown: %w", err)
+	}
+
+	log.Println("HTTP server drained")
+	return nil
+}
+
+func CreateServer(port int, handler http.Handler, wrappers ...ListenerWrapper) Server {
+	return CreateServerAt("", port, handler, wrappers...)
+}
+
+// CreateServerAt creates a server listening on the given host only, an
+// empty host listens on every interface.
+func CreateServerAt(host string, port int, handler http.Handler, wrappers ...ListenerWrapper) Server {
 	return server{
 		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
+			Addr:           net.JoinHostPort(host, strconv.Itoa(port)),
 			Handler:        handler,
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   10 * time.Second,
 			MaxHeaderBytes: 1 << 20,
 		},
+		wrappers: wrappers,
 	}
 }
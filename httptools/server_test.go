@@ -0,0 +1,145 @@
+package httptools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func waitListening(t *testing.T, address string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s is not listening", address)
+}
+
+func TestServerShutdownDrainsRequests(t *testing.T) {
+	port := freePort(t)
+	address := fmt.Sprintf("localhost:%d", port)
+
+	started := make(chan struct{})
+	server := CreateServer(port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = rw.Write([]byte("done"))
+	}))
+	server.Start()
+	waitListening(t, address)
+
+	type result struct {
+		body string
+		err error
+	}
+	results := make(chan result)
+
+	go func() {
+		resp, err := http.Get("http://" + address)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		results <- result{body: string(body), err: err}
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.Nil(t, server.Shutdown(ctx), "in-flight request completes before deadline")
+
+	res := <-results
+	assert.Nil(t, res.err)
+	assert.Equal(t, "done", res.body)
+
+	_, err := net.Dial("tcp", address)
+	assert.NotNil(t, err, "no new connections after shutdown")
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	port := freePort(t)
+	address := fmt.Sprintf("localhost:%d", port)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	server := CreateServer(port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	server.Start()
+	waitListening(t, address)
+
+	go http.Get("http://" + address)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "error is reported instead of exiting")
+}
+
+func TestServerListensOnStart(t *testing.T) {
+	port := freePort(t)
+
+	server := CreateServer(port, http.NotFoundHandler())
+	server.Start()
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	assert.Nil(t, err, "connections are accepted once Start returns")
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func TestServerListensOnHost(t *testing.T) {
+	port := freePort(t)
+
+	server := CreateServerAt("127.0.0.1", port, http.NotFoundHandler())
+	server.Start()
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.Nil(t, err)
+	if err == nil {
+		conn.Close()
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	assert.Nil(t, err)
+
+	for _, addr := range addrs {
+		ip := addr.(*net.IPNet).IP
+		if ip.IsLoopback() || ip.To4() == nil {
+			continue
+		}
+
+		_, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), fmt.Sprint(port)), time.Second)
+		assert.NotNil(t, err, "server does not listen on %s", ip)
+	}
+}
@@ -29,6 +29,7 @@ const (
 	MaxAttemptsToGetInterface = 20
 	MaxAttemptsToGetBalancerIP = 20
 	BalancerPort = 8090
+	BenchmarkParallelism = 16
 )
 
 var BaseAddress = "http://balancer:8090"
@@ -307,50 +308,70 @@ func balancerHttpGetTest(t *testing.T) {
 	<-wait
 }
 
+func benchmarkBalancerGet(b *testing.B, client *http.Client, urlBalancer string) {
+	resp, err := client.Get(urlBalancer)
+	if err != nil {
+		err = FormatError(
+			err,
+			"%#v.Get(%#v)",
+			client,
+			urlBalancer,
+		)
+
+		b.Error(err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		err = FormatError(
+			err,
+			"io.ReadAll(%#v)",
+			resp.Body,
+		)
+		b.Error(err)
+		return
+	}
+
+	if resp.StatusCode != 200 {
+		err = FormatError(
+			fmt.Errorf("%#v", string(bodyBytes)),
+			"%#v.StatusCode != %#v for request",
+			resp,
+			resp.StatusCode,
+		)
+		b.Error(err)
+	}
+}
+
 func BenchmarkBalancer(b *testing.B) {
 	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
 		b.Skip("Integration test is not enabled")
 	}
 
-	client := http.Client{Timeout: 3 * time.Second}
+	client := &http.Client{Timeout: 3 * time.Second}
 
 	urlBalancer := fmt.Sprintf("%s/api/v1/some-data", BaseAddress)
-	for i := 0; i < b.N; i++ {
-		resp, err := client.Get(urlBalancer)
-		if err != nil {
-			err = FormatError(
-				err,
-				"%#v.Get(%#v)",
-				client,
-				urlBalancer,
-			)
 
-			b.Error(err)
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchmarkBalancerGet(b, client, urlBalancer)
 		}
-
-		if resp.StatusCode != 200 {
-			bodyBytes, err := io.ReadAll(resp.Request.Body)
-
-			if err != nil {
-				err = FormatError(
-					err,
-					"io.ReadAll(%#v)",
-					resp.Request.Body,
-				)
-				panic(err)
+	})
+
+	// concurrent clients make the balancer keep several connections to
+	// every backend, which is where its connection pools pay off
+	b.Run("parallel", func(b *testing.B) {
+		b.SetParallelism(BenchmarkParallelism)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				benchmarkBalancerGet(b, client, urlBalancer)
 			}
-
-			err = FormatError(
-				fmt.Errorf("%#v", string(bodyBytes)),
-				"%#v.StatusCode != %#v for request",
-				resp,
-				resp.StatusCode,
-			)
-			b.Error(err)
-		}
-
-		resp.Body.Close()
-	}
+		})
+	})
 }
 
 func localIPNetTest(t *testing.T) {
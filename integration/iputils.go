@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"slices"
 	"bytes"
+
+	"github.com/magicvegetable/architecture-lab-4/iptools"
 )
 
 import . "github.com/magicvegetable/architecture-lab-4/err"
@@ -484,223 +486,6 @@ func RandIPNetVersion(version int) (*net.IPNet, error) {
 	return randIPNet(size), nil
 }
 
-func IPNetsIntersect(ipNet1 *net.IPNet, ipNet2 *net.IPNet) (bool, error) {
-	if ipNet1 == nil {
-		err := FormatError(nil, "ipNet1 have to be not %#v", ipNet1)
-		return false, err
-	}
-
-	if ipNet2 == nil {
-		err := FormatError(nil, "ipNet2 have to be not %#v", ipNet2)
-		return false, err
-	}
-
-	ones1, bits1 := ipNet1.Mask.Size()
-
-	ones2, bits2 := ipNet2.Mask.Size()
-
-	if bits1 != bits2 {
-		return false, nil
-	}
-
-	var lowestOnes int
-
-	if ones1 > ones2 {
-		lowestOnes = ones2
-	} else {
-		lowestOnes = ones1
-	}
-
-	for i := 0; i < lowestOnes / 8; i++ {
-		if ipNet1.IP[i] != ipNet2.IP[i] {
-			return false, nil
-		}
-	}
-
-	byteIndex := lowestOnes / 8
-	clearBits := 8 - lowestOnes % 8
-
-	checkBits1 := ipNet1.IP[byteIndex]
-	checkBits2 := ipNet2.IP[byteIndex]
-
-	checkBits1 >>= clearBits
-	checkBits1 <<= clearBits
-
-	checkBits2 >>= clearBits
-	checkBits2 <<= clearBits
-
-	return checkBits1 == checkBits2, nil
-}
-
-func IPNetIntersectIPNets(ipNet *net.IPNet, ipNets []*net.IPNet) (bool, error) {
-	if ipNet == nil {
-		err := FormatError(nil, "ipNet have to be not %#v", ipNet)
-		return false, err
-	}
-
-	if ipNets == nil {
-		return false, nil
-	}
-
-	for _, subIPNet := range ipNets {
-		intersect, err := IPNetsIntersect(subIPNet, ipNet)
-
-		if err != nil {
-			err = FormatError(err, "IPNetsIntersect(%#v, %#v)", subIPNet, ipNet)
-			return false, err
-		}
-
-		if intersect {
-			return intersect, err
-		}
-	}
-
-	return false, nil
-}
-
-func getBitsSizeByVersion(version int) (int, error) {
-	maskBits := map[int]int{
-		4: 32,
-		6: 128,
-	}
-
-	bits, contains := maskBits[version]
-
-	if !contains {
-		err := FormatError(nil, "Not supported version %#v", version)
-		return 0, err
-	}
-
-	return bits, nil
-}
-
-func ipNetIncludes(ipNet *net.IPNet, subIPNet *net.IPNet) bool {
-	if ipNet == nil || subIPNet == nil {
-		return false
-	}
-
-	ipNetOnes, ipNetBits := ipNet.Mask.Size()
-
-	subIPNetOnes, subIPNetBits := subIPNet.Mask.Size()
-
-	if ipNetBits != subIPNetBits {
-		return false
-	}
-
-	if subIPNetOnes < ipNetOnes {
-		return false
-	}
-
-	for i := 0; i < ipNetOnes; i++ {
-		byteI := i / 8
-		bitI := 7 - i % 8
-
-		settedBit := byte(1 << bitI)
-
-		ipNetBit := ipNet.IP[byteI]
-		ipNetBit &= settedBit
-
-		subIPNetBit := subIPNet.IP[byteI]
-		subIPNetBit &= settedBit
-
-		if ipNetBit != subIPNetBit {
-			return false
-		}
-	}
-
-	return true
-}
-
-func ipNetExclude(ipNet *net.IPNet, subIPNet *net.IPNet) []*net.IPNet {
-	if ipNet == nil {
-		return nil
-	}
-
-	if !ipNetIncludes(ipNet, subIPNet) {
-		return []*net.IPNet{ipNet}
-	}
-
-	ipNetOnes, ipNetBits := ipNet.Mask.Size()
-
-	subIPNetOnes, _ := subIPNet.Mask.Size()
-
-	var leftIPNets []*net.IPNet
-
-	for i := ipNetOnes; i < subIPNetOnes; i++ {
-		byteI := i / 8
-		bitI := 7 - i % 8
-
-		leftIP := make(net.IP, len(ipNet.IP))
-		copy(leftIP, subIPNet.IP[:byteI + 1])
-
-
-		leftIPNet := &net.IPNet{
-			IP: leftIP,
-			Mask: net.CIDRMask(i + 1, ipNetBits),
-		}
-
-		settedBit := byte(1 << bitI)
-
-		leftIPNetBit := leftIPNet.IP[byteI]
-		leftIPNetBit &= settedBit
-
-		if leftIPNetBit == 0 {
-			leftIPNet.IP[byteI] += settedBit
-		} else {
-			leftIPNet.IP[byteI] -= settedBit
-		}
-
-		clearBits := bitI
-
-		leftIPNet.IP[byteI] >>= clearBits
-		leftIPNet.IP[byteI] <<= clearBits
-
-		leftIPNets = append(leftIPNets, leftIPNet)
-	}
-
-	return leftIPNets
-}
-
-func FreeIPNets(version int, ipNets []*net.IPNet) ([]*net.IPNet, error) {
-	bitsSize, err := getBitsSizeByVersion(version)
-
-	if err != nil {
-		err = FormatError(err, "getBitsSizeByVersion(%#v)", version)
-		return nil, err
-	}
-
-	freeIPNets := []*net.IPNet{
-		// the biggest net
-		&net.IPNet{
-			Mask: net.CIDRMask(0, bitsSize),
-			IP: make(net.IP, bitsSize / 8),
-		},
-	}
-
-	for _, ipNet := range ipNets {
-		var filteredFreeIPNets []*net.IPNet
-
-		for _, freeIPNet := range freeIPNets {
-			if ipNetIncludes(ipNet, freeIPNet) {
-				continue
-			}
-
-			if !ipNetIncludes(freeIPNet, ipNet) {
-				filteredFreeIPNets = append(filteredFreeIPNets, freeIPNet)
-				continue
-			}
-
-			subFreeIPNets := ipNetExclude(freeIPNet, ipNet)
-
-			filteredFreeIPNets = append(filteredFreeIPNets, subFreeIPNets...)
-		}
-
-		freeIPNets = filteredFreeIPNets
-	}
-
-	return freeIPNets, nil
-}
-
 func RandIPNetFilterNoIntersectMinDiff(ipNets []*net.IPNet, diff int) (*net.IPNet, error) {
 	for i := 0; i < MAX_AMOUNT_OF_TRY; i++ {
 		randIPNet := RandIPNet()
@@ -711,7 +496,7 @@ func RandIPNetFilterNoIntersectMinDiff(ipNets []*net.IPNet, diff int) (*net.IPNe
 			continue
 		}
 
-		intersect, err := IPNetIntersectIPNets(randIPNet, ipNets)
+		intersect, err := iptools.IPNetIntersectIPNets(randIPNet, ipNets)
 
 		if err != nil {
 			err = FormatError(err, "IPNetIntersectIPNets(%#v, %#v)", randIPNet, ipNets)
@@ -725,7 +510,7 @@ func RandIPNetFilterNoIntersectMinDiff(ipNets []*net.IPNet, diff int) (*net.IPNe
 
 	version := []int{4,6}[rand.Int() % 2]
 
-	freeIPNets, err := FreeIPNets(version, ipNets)
+	freeIPNets, err := iptools.FreeIPNets(version, ipNets)
 
 	if err != nil {
 		err = FormatError(err, "freeIPNets(%#v, %#v)", version, ipNets)
@@ -763,7 +548,7 @@ func RandIPNetVersionFilterNoIntersect(version int, ipNets []*net.IPNet) (*net.I
 			return nil, err
 		}
 
-		intersect, err := IPNetIntersectIPNets(randIPNet, ipNets)
+		intersect, err := iptools.IPNetIntersectIPNets(randIPNet, ipNets)
 
 		if err != nil {
 			err = FormatError(err, "IPNetIntersectIPNets(%#v, %#v)", randIPNet, ipNets)
@@ -775,7 +560,7 @@ func RandIPNetVersionFilterNoIntersect(version int, ipNets []*net.IPNet) (*net.I
 		}
 	}
 
-	freeIPNets, err := FreeIPNets(version, ipNets)
+	freeIPNets, err := iptools.FreeIPNets(version, ipNets)
 
 	if err != nil {
 		err = FormatError(err, "freeIPNets(%#v, %#v)", version, ipNets)
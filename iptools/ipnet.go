@@ -0,0 +1,238 @@
+// Package iptools implements arithmetic on IP prefixes and a prefix trie
+// for matching addresses against many of them.
+package iptools
+
+import (
+	"net"
+)
+
+import . "github.com/magicvegetable/architecture-lab-4/err"
+
+// IPNetsIntersect reports whether the networks share any address.
+func IPNetsIntersect(ipNet1 *net.IPNet, ipNet2 *net.IPNet) (bool, error) {
+	if ipNet1 == nil {
+		err := FormatError(nil, "ipNet1 have to be not %#v", ipNet1)
+		return false, err
+	}
+
+	if ipNet2 == nil {
+		err := FormatError(nil, "ipNet2 have to be not %#v", ipNet2)
+		return false, err
+	}
+
+	ones1, bits1 := ipNet1.Mask.Size()
+
+	ones2, bits2 := ipNet2.Mask.Size()
+
+	if bits1 != bits2 {
+		return false, nil
+	}
+
+	var lowestOnes int
+
+	if ones1 > ones2 {
+		lowestOnes = ones2
+	} else {
+		lowestOnes = ones1
+	}
+
+	for i := 0; i < lowestOnes / 8; i++ {
+		if ipNet1.IP[i] != ipNet2.IP[i] {
+			return false, nil
+		}
+	}
+
+	// a whole byte prefix has no partial byte left to compare
+	if lowestOnes % 8 == 0 {
+		return true, nil
+	}
+
+	byteIndex := lowestOnes / 8
+	clearBits := 8 - lowestOnes % 8
+
+	checkBits1 := ipNet1.IP[byteIndex]
+	checkBits2 := ipNet2.IP[byteIndex]
+
+	checkBits1 >>= clearBits
+	checkBits1 <<= clearBits
+
+	checkBits2 >>= clearBits
+	checkBits2 <<= clearBits
+
+	return checkBits1 == checkBits2, nil
+}
+
+// IPNetIntersectIPNets reports whether the network shares any address with
+// one of the networks.
+func IPNetIntersectIPNets(ipNet *net.IPNet, ipNets []*net.IPNet) (bool, error) {
+	if ipNet == nil {
+		err := FormatError(nil, "ipNet have to be not %#v", ipNet)
+		return false, err
+	}
+
+	if ipNets == nil {
+		return false, nil
+	}
+
+	for _, subIPNet := range ipNets {
+		intersect, err := IPNetsIntersect(subIPNet, ipNet)
+
+		if err != nil {
+			err = FormatError(err, "IPNetsIntersect(%#v, %#v)", subIPNet, ipNet)
+			return false, err
+		}
+
+		if intersect {
+			return intersect, err
+		}
+	}
+
+	return false, nil
+}
+
+func getBitsSizeByVersion(version int) (int, error) {
+	maskBits := map[int]int{
+		4: 32,
+		6: 128,
+	}
+
+	bits, contains := maskBits[version]
+
+	if !contains {
+		err := FormatError(nil, "Not supported version %#v", version)
+		return 0, err
+	}
+
+	return bits, nil
+}
+
+// IPNetIncludes reports whether subIPNet lies within ipNet.
+func IPNetIncludes(ipNet *net.IPNet, subIPNet *net.IPNet) bool {
+	if ipNet == nil || subIPNet == nil {
+		return false
+	}
+
+	ipNetOnes, ipNetBits := ipNet.Mask.Size()
+
+	subIPNetOnes, subIPNetBits := subIPNet.Mask.Size()
+
+	if ipNetBits != subIPNetBits {
+		return false
+	}
+
+	if subIPNetOnes < ipNetOnes {
+		return false
+	}
+
+	for i := 0; i < ipNetOnes; i++ {
+		byteI := i / 8
+		bitI := 7 - i % 8
+
+		settedBit := byte(1 << bitI)
+
+		ipNetBit := ipNet.IP[byteI]
+		ipNetBit &= settedBit
+
+		subIPNetBit := subIPNet.IP[byteI]
+		subIPNetBit &= settedBit
+
+		if ipNetBit != subIPNetBit {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ipNetExclude splits ipNet into the networks covering it except subIPNet.
+func ipNetExclude(ipNet *net.IPNet, subIPNet *net.IPNet) []*net.IPNet {
+	if ipNet == nil {
+		return nil
+	}
+
+	if !IPNetIncludes(ipNet, subIPNet) {
+		return []*net.IPNet{ipNet}
+	}
+
+	ipNetOnes, ipNetBits := ipNet.Mask.Size()
+
+	subIPNetOnes, _ := subIPNet.Mask.Size()
+
+	var leftIPNets []*net.IPNet
+
+	for i := ipNetOnes; i < subIPNetOnes; i++ {
+		byteI := i / 8
+		bitI := 7 - i % 8
+
+		leftIP := make(net.IP, len(ipNet.IP))
+		copy(leftIP, subIPNet.IP[:byteI + 1])
+
+
+		leftIPNet := &net.IPNet{
+			IP: leftIP,
+			Mask: net.CIDRMask(i + 1, ipNetBits),
+		}
+
+		settedBit := byte(1 << bitI)
+
+		leftIPNetBit := leftIPNet.IP[byteI]
+		leftIPNetBit &= settedBit
+
+		if leftIPNetBit == 0 {
+			leftIPNet.IP[byteI] += settedBit
+		} else {
+			leftIPNet.IP[byteI] -= settedBit
+		}
+
+		clearBits := bitI
+
+		leftIPNet.IP[byteI] >>= clearBits
+		leftIPNet.IP[byteI] <<= clearBits
+
+		leftIPNets = append(leftIPNets, leftIPNet)
+	}
+
+	return leftIPNets
+}
+
+// FreeIPNets covers the address space of the IP version not taken by any
+// of the networks.
+func FreeIPNets(version int, ipNets []*net.IPNet) ([]*net.IPNet, error) {
+	bitsSize, err := getBitsSizeByVersion(version)
+
+	if err != nil {
+		err = FormatError(err, "getBitsSizeByVersion(%#v)", version)
+		return nil, err
+	}
+
+	freeIPNets := []*net.IPNet{
+		// the biggest net
+		&net.IPNet{
+			Mask: net.CIDRMask(0, bitsSize),
+			IP: make(net.IP, bitsSize / 8),
+		},
+	}
+
+	for _, ipNet := range ipNets {
+		var filteredFreeIPNets []*net.IPNet
+
+		for _, freeIPNet := range freeIPNets {
+			if IPNetIncludes(ipNet, freeIPNet) {
+				continue
+			}
+
+			if !IPNetIncludes(freeIPNet, ipNet) {
+				filteredFreeIPNets = append(filteredFreeIPNets, freeIPNet)
+				continue
+			}
+
+			subFreeIPNets := ipNetExclude(freeIPNet, ipNet)
+
+			filteredFreeIPNets = append(filteredFreeIPNets, subFreeIPNets...)
+		}
+
+		freeIPNets = filteredFreeIPNets
+	}
+
+	return freeIPNets, nil
+}
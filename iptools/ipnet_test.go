@@ -0,0 +1,64 @@
+package iptools
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cidr(t testing.TB, s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	assert.Nil(t, err)
+	return ipNet
+}
+
+func TestIPNetsIntersect(t *testing.T) {
+	cases := []struct {
+		a, b string
+		intersect bool
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", true},
+		{"10.0.0.0/8", "11.0.0.0/8", false},
+		{"192.168.1.0/25", "192.168.1.128/25", false},
+		{"192.168.1.0/24", "192.168.1.200/32", true},
+		{"192.168.1.7/32", "192.168.1.7/32", true},
+		{"192.168.1.7/32", "192.168.1.8/32", false},
+		{"10.0.0.0/8", "fd00::/8", false},
+		{"fd00::/8", "fd12:3456::/32", true},
+	}
+
+	for _, c := range cases {
+		intersect, err := IPNetsIntersect(cidr(t, c.a), cidr(t, c.b))
+		assert.Nil(t, err)
+		assert.Equal(t, c.intersect, intersect, "%s and %s", c.a, c.b)
+	}
+
+	_, err := IPNetsIntersect(nil, cidr(t, "10.0.0.0/8"))
+	assert.NotNil(t, err)
+}
+
+func TestIPNetIncludes(t *testing.T) {
+	assert.True(t, IPNetIncludes(cidr(t, "10.0.0.0/8"), cidr(t, "10.20.0.0/16")))
+	assert.False(t, IPNetIncludes(cidr(t, "10.20.0.0/16"), cidr(t, "10.0.0.0/8")))
+	assert.False(t, IPNetIncludes(cidr(t, "10.0.0.0/8"), cidr(t, "11.0.0.0/16")))
+	assert.False(t, IPNetIncludes(cidr(t, "::/0"), cidr(t, "10.0.0.0/8")))
+}
+
+func TestFreeIPNets(t *testing.T) {
+	taken := []*net.IPNet{cidr(t, "0.0.0.0/1"), cidr(t, "192.0.0.0/2")}
+
+	free, err := FreeIPNets(4, taken)
+	assert.Nil(t, err)
+	assert.Len(t, free, 1)
+	assert.Equal(t, "128.0.0.0/2", free[0].String())
+
+	for _, ipNet := range free {
+		intersect, err := IPNetIntersectIPNets(ipNet, taken)
+		assert.Nil(t, err)
+		assert.False(t, intersect)
+	}
+
+	_, err = FreeIPNets(5, taken)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,118 @@
+package iptools
+
+import (
+	"net"
+)
+
+import . "github.com/magicvegetable/architecture-lab-4/err"
+
+type trieNode[V any] struct {
+	children [2]*trieNode[V]
+	value V
+	set bool
+}
+
+// Trie maps IPv4 and IPv6 networks to values and finds the most specific
+// network containing an address in time bounded by the address length.
+// Lookups are safe for concurrent use once the trie is built.
+type Trie[V any] struct {
+	v4 trieNode[V]
+	v6 trieNode[V]
+	size int
+}
+
+// normalize returns the 4 byte form of IPv4 addresses, the IPv4-mapped
+// IPv6 ones included.
+func normalize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip.To16()
+}
+
+func (t *Trie[V]) root(ip net.IP) *trieNode[V] {
+	if len(ip) == net.IPv4len {
+		return &t.v4
+	}
+
+	return &t.v6
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i / 8] >> (7 - i % 8)) & 1
+}
+
+// Insert maps the network to the value, replacing the value of the same
+// network inserted before.
+func (t *Trie[V]) Insert(ipNet *net.IPNet, value V) error {
+	if ipNet == nil {
+		return FormatError(nil, "ipNet have to be not %#v", ipNet)
+	}
+
+	ip := normalize(ipNet.IP)
+	ones, bits := ipNet.Mask.Size()
+
+	if ip == nil || bits != len(ip) * 8 {
+		return FormatError(nil, "Not supported network %v", ipNet)
+	}
+
+	node := t.root(ip)
+
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+
+		if node.children[b] == nil {
+			node.children[b] = &trieNode[V]{}
+		}
+
+		node = node.children[b]
+	}
+
+	if !node.set {
+		t.size += 1
+	}
+
+	node.value = value
+	node.set = true
+
+	return nil
+}
+
+// Lookup returns the value of the longest network containing the address.
+func (t *Trie[V]) Lookup(ip net.IP) (V, bool) {
+	var value V
+	found := false
+
+	ip = normalize(ip)
+	if ip == nil {
+		return value, false
+	}
+
+	node := t.root(ip)
+
+	for i := 0; node != nil; i++ {
+		if node.set {
+			value, found = node.value, true
+		}
+
+		if i == len(ip) * 8 {
+			break
+		}
+
+		node = node.children[bit(ip, i)]
+	}
+
+	return value, found
+}
+
+// Contains reports whether any network in the trie contains the address.
+func (t *Trie[V]) Contains(ip net.IP) bool {
+	_, found := t.Lookup(ip)
+	return found
+}
+
+// Len returns the number of networks in the trie.
+func (t *Trie[V]) Len() int {
+	return t.size
+}
@@ -0,0 +1,73 @@
+package iptools
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrieLookup(t *testing.T) {
+	trie := Trie[string]{}
+
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32", "0.0.0.0/0", "fd00::/8", "fd00:1::/32"} {
+		assert.Nil(t, trie.Insert(cidr(t, s), s))
+	}
+
+	cases := map[string]string{
+		"10.200.0.1": "10.0.0.0/8",
+		"10.1.9.9": "10.1.0.0/16",
+		"10.1.2.3": "10.1.2.3/32",
+		"192.168.0.1": "0.0.0.0/0",
+		"::ffff:10.1.9.9": "10.1.0.0/16",
+		"fd00:1::5": "fd00:1::/32",
+		"fd99::1": "fd00::/8",
+	}
+
+	for ip, expected := range cases {
+		value, found := trie.Lookup(net.ParseIP(ip))
+		assert.True(t, found, ip)
+		assert.Equal(t, expected, value, ip)
+	}
+
+	assert.False(t, trie.Contains(net.ParseIP("2001:db8::1")), "IPv4 networks do not match IPv6 addresses")
+	assert.False(t, trie.Contains(nil))
+	assert.Equal(t, 6, trie.Len())
+
+	assert.Nil(t, trie.Insert(cidr(t, "10.0.0.0/8"), "replaced"))
+	value, _ := trie.Lookup(net.ParseIP("10.200.0.1"))
+	assert.Equal(t, "replaced", value)
+	assert.Equal(t, 6, trie.Len())
+
+	assert.NotNil(t, trie.Insert(nil, ""))
+}
+
+func BenchmarkTrieLookup(b *testing.B) {
+	trie := Trie[int]{}
+	var ipNets []*net.IPNet
+
+	for i := 0; i < 1000; i++ {
+		ipNet := cidr(b, fmt.Sprintf("10.%d.%d.0/24", i / 256, i % 256))
+		ipNets = append(ipNets, ipNet)
+		_ = trie.Insert(ipNet, i)
+	}
+
+	ip := net.ParseIP("10.3.200.17")
+
+	b.Run("trie", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			trie.Lookup(ip)
+		}
+	})
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, ipNet := range ipNets {
+				if ipNet.Contains(ip) {
+					break
+				}
+			}
+		}
+	})
+}
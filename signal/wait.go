@@ -8,8 +8,21 @@ import (
 )
 
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
+	intChannel := make(chan os.Signal, 1)
 	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-intChannel
 	log.Println("Shutting down...")
 }
+
+// OnReloadSignal calls reload every time the process receives SIGHUP.
+func OnReloadSignal(reload func()) {
+	hupChannel := make(chan os.Signal, 1)
+	signal.Notify(hupChannel, syscall.SIGHUP)
+
+	go func() {
+		for range hupChannel {
+			log.Println("Reloading...")
+			reload()
+		}
+	}()
+}